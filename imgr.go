@@ -1,24 +1,34 @@
 package main
 
 import (
+  "bytes"
+  "encoding/binary"
+  "encoding/csv"
   "encoding/json"
   "fmt"
   "image"
+  "image/color"
   "image/gif"
   "image/jpeg"
   "image/png"
   _ "image/gif"
   _ "image/jpeg"
   _ "image/png"
+  "math"
   "os"
   "path/filepath"
+  "runtime"
+  "strconv"
   "strings"
+  "sync"
 
   "github.com/strukturag/libheif/go/heif"
   "github.com/urfave/cli/v2"
   "golang.org/x/image/bmp"
   "golang.org/x/image/draw"
+  "golang.org/x/image/math/f64"
   "golang.org/x/image/tiff"
+  "golang.org/x/image/vector"
   _ "golang.org/x/image/bmp"
   _ "golang.org/x/image/tiff"
   _ "golang.org/x/image/webp"
@@ -29,29 +39,155 @@ type Size struct {
   Height                int `json:"height"`
 }
 
+type Point struct {
+  X                     int `json:"x"`
+  Y                     int `json:"y"`
+}
+
+type Region struct {
+  X1                    int `json:"x1"`
+  Y1                    int `json:"y1"`
+  X2                    int `json:"x2"`
+  Y2                    int `json:"y2"`
+}
+
 type TransformResult struct {
-  InputFile             string `json:"input_file"`
-  OutputFile            string `json:"output_file"`
-  Format                string `json:"format"`
-  OriginalSize          Size   `json:"original_size"`
-  FinalSize             Size   `json:"final_size"`
-  Resized               bool   `json:"resized"`
-  Message               string `json:"message"`
+  InputFile             string   `json:"input_file"`
+  OutputFile            string   `json:"output_file"`
+  Format                string   `json:"format"`
+  OriginalSize          Size     `json:"original_size"`
+  FinalSize             Size     `json:"final_size"`
+  Resized               bool     `json:"resized"`
+  Mode                  string   `json:"mode"`
+  CropRegion            *Region  `json:"crop_region,omitempty"`
+  CropScore             *float64 `json:"crop_score,omitempty"`
+  PlacementOffset       *Point   `json:"placement_offset,omitempty"`
+  TrimRegion            *Region  `json:"trim_region,omitempty"`
+  Rotation              float64  `json:"rotation"`
+  Geometry              []string `json:"geometry,omitempty"`
+  Filter                string   `json:"filter"`
+  LinearLight           bool     `json:"linear_light"`
+  ColorModel            string   `json:"color_model"`
+  Message               string   `json:"message"`
 }
 
 type ClipResult struct {
-  InputFile             string `json:"input_file"`
+  InputFile             string   `json:"input_file"`
+  OutputFile            string   `json:"output_file"`
+  Format                string   `json:"format"`
+  OriginalSize          Size     `json:"original_size"`
+  Name                  string   `json:"name,omitempty"`
+  Mode                  string   `json:"mode"`
+  Gravity               string   `json:"gravity,omitempty"`
+  Aspect                string   `json:"aspect,omitempty"`
+  Shape                 string   `json:"shape,omitempty"`
+  Overflow              string   `json:"overflow"`
+  RequestedRegion       *Region  `json:"requested_region,omitempty"`
+  PlacementOffset       *Point   `json:"placement_offset,omitempty"`
+  ClipRegion            Region   `json:"clip_region"`
+  ClipSize              Size     `json:"clip_size"`
+  Score                 *float64 `json:"score,omitempty"`
+  ColorModel            string   `json:"color_model"`
+  Message               string   `json:"message"`
+}
+
+type TrimResult struct {
+  InputFile             string   `json:"input_file"`
+  OutputFile            string   `json:"output_file,omitempty"`
+  Format                string   `json:"format"`
+  OriginalSize          Size     `json:"original_size"`
+  Background            string   `json:"background"`
+  Fuzz                  float64  `json:"fuzz"`
+  BoundingBox           Region   `json:"bounding_box"`
+  TrimmedSize           Size     `json:"trimmed_size"`
+  Message               string   `json:"message"`
+}
+
+type DeskewResult struct {
+  InputFile             string   `json:"input_file"`
+  OutputFile            string   `json:"output_file"`
+  Format                string   `json:"format"`
+  OriginalSize          Size     `json:"original_size"`
+  FinalSize             Size     `json:"final_size"`
+  SkewAngle             float64  `json:"skew_angle"`
+  Rotation              float64  `json:"rotation"`
+  Background            string   `json:"background"`
+  Filter                string   `json:"filter"`
+  ColorModel            string   `json:"color_model"`
+  Message               string   `json:"message"`
+}
+
+type Corner struct {
+  X                     float64 `json:"x"`
+  Y                     float64 `json:"y"`
+}
+
+type PerspectiveResult struct {
+  InputFile             string   `json:"input_file"`
+  OutputFile            string   `json:"output_file"`
+  Format                string   `json:"format"`
+  OriginalSize          Size     `json:"original_size"`
+  Corners               []Corner `json:"corners"`
+  FinalSize             Size     `json:"final_size"`
+  SizeInferred          bool     `json:"size_inferred"`
+  Filter                string   `json:"filter"`
+  ColorModel            string   `json:"color_model"`
+  Message               string   `json:"message"`
+}
+
+type AffineResult struct {
+  InputFile             string       `json:"input_file"`
+  OutputFile            string       `json:"output_file"`
+  Format                string       `json:"format"`
+  OriginalSize          Size         `json:"original_size"`
+  FinalSize             Size         `json:"final_size"`
+  Matrix                [ 6 ]float64 `json:"matrix"`
+  Filter                string       `json:"filter"`
+  ColorModel            string       `json:"color_model"`
+  Message               string       `json:"message"`
+}
+
+type Tile struct {
+  Row                   int    `json:"row"`
+  Column                int    `json:"column"`
   OutputFile            string `json:"output_file"`
-  Format                string `json:"format"`
-  OriginalSize          Size   `json:"original_size"`
-  ClipRegion            struct {
-    X1                int `json:"x1"`
-    Y1                int `json:"y1"`
-    X2                int `json:"x2"`
-    Y2                int `json:"y2"`
-  }                     `json:"clip_region"`
-  ClipSize              Size   `json:"clip_size"`
-  Message               string `json:"message"`
+  Region                Region `json:"region"`
+  Size                  Size   `json:"size"`
+  Padded                bool   `json:"padded,omitempty"`
+}
+
+type TileResult struct {
+  InputFile             string  `json:"input_file"`
+  Format                string  `json:"format"`
+  OriginalSize          Size    `json:"original_size"`
+  TileSize              Size    `json:"tile_size"`
+  Overlap               int     `json:"overlap"`
+  Edge                  string  `json:"edge"`
+  Rows                  int     `json:"rows"`
+  Columns               int     `json:"columns"`
+  Tiles                 []Tile  `json:"tiles"`
+  Message               string  `json:"message"`
+}
+
+type Sprite struct {
+  Index                 int    `json:"index"`
+  OutputFile            string `json:"output_file,omitempty"`
+  BoundingBox           Region `json:"bounding_box"`
+  Region                Region `json:"region"`
+  Size                  Size   `json:"size"`
+  Area                  int    `json:"area"`
+}
+
+type SpritesResult struct {
+  InputFile             string   `json:"input_file"`
+  Format                string   `json:"format"`
+  OriginalSize          Size     `json:"original_size"`
+  Background            string   `json:"background"`
+  Fuzz                  float64  `json:"fuzz"`
+  Connectivity          int      `json:"connectivity"`
+  Padding               int      `json:"padding"`
+  Sprites               []Sprite `json:"sprites"`
+  Message               string   `json:"message"`
 }
 
 type InfoResult struct {
@@ -63,6 +199,7 @@ type InfoResult struct {
   AspectRatio           float64 `json:"aspect_ratio"`
   HasAlpha              bool    `json:"has_alpha"`
   ColorModel            string  `json:"color_model"`
+  Orientation           int     `json:"orientation"`
   FileSize              int64   `json:"file_size_bytes"`
   FileSizeKB            float64 `json:"file_size_kb"`
 }
@@ -77,6 +214,8 @@ type CommandResult struct {
   Error                 *ErrorResult `json:"error,omitempty"`
 }
 
+const maxDimension = 65535
+
 func main() {
   cli.HelpFlag = &cli.BoolFlag{
     Name:  "help",
@@ -96,6 +235,10 @@ func main() {
         Name:         "json",
         Usage:        "output results as JSON",
       },
+      &cli.BoolFlag{
+        Name:         "no-auto-orient",
+        Usage:        "keep pixels as stored instead of applying the EXIF or HEIF orientation",
+      },
     },
     Commands: []*cli.Command{
       {
@@ -125,12 +268,99 @@ func main() {
             Name:     "no-enlarge",
             Usage:    "never make image larger than source",
           },
-          &cli.IntFlag{
+          &cli.Float64Flag{
             Name:     "rotate",
             Aliases:  []string{ "r" },
-            Usage:    "rotate image clockwise (90, 180, or 270 degrees)",
+            Usage:    "rotate image clockwise by any angle in degrees (negative for counter-clockwise)",
             Value:    0,
           },
+          &cli.BoolFlag{
+            Name:     "flip",
+            Usage:    "mirror the image vertically (top to bottom)",
+          },
+          &cli.BoolFlag{
+            Name:     "flop",
+            Usage:    "mirror the image horizontally (left to right)",
+          },
+          &cli.BoolFlag{
+            Name:     "transpose",
+            Usage:    "mirror the image across the top-left to bottom-right diagonal",
+          },
+          &cli.BoolFlag{
+            Name:     "transverse",
+            Usage:    "mirror the image across the top-right to bottom-left diagonal",
+          },
+          &cli.BoolFlag{
+            Name:     "expand",
+            Usage:    "grow the canvas to fit the whole rotated image instead of keeping the original size",
+          },
+          &cli.IntFlag{
+            Name:     "depth",
+            Usage:    "output bits per channel (8 or 16, default keeps the source depth)",
+          },
+          &cli.BoolFlag{
+            Name:     "trim",
+            Usage:    "remove uniform borders matching the corner color before resizing",
+          },
+          &cli.StringFlag{
+            Name:     "fuzz",
+            Usage:    "color tolerance for trimming, as a percentage (such as 5%)",
+            Value:    "0",
+          },
+          &cli.StringFlag{
+            Name:     "filter",
+            Usage:    "resampling filter (nearest, bilinear, catmull-rom, lanczos3, or box)",
+            Value:    "bilinear",
+          },
+          &cli.BoolFlag{
+            Name:     "linear",
+            Usage:    "resample in linear light instead of sRGB (gamma-correct, slower)",
+          },
+          &cli.IntFlag{
+            Name:     "threads",
+            Usage:    "number of goroutines used for resampling (default: GOMAXPROCS)",
+          },
+          &cli.StringFlag{
+            Name:     "mode",
+            Aliases:  []string{ "m" },
+            Usage:    "resize mode when both width and height are given (fit, cover, pad, stretch, or seam)",
+            Value:    "fit",
+          },
+          &cli.StringFlag{
+            Name:     "gravity",
+            Aliases:  []string{ "g" },
+            Usage:    "anchor for cropping or padding (center, north, south, east, west, northeast, " +
+                      "northwest, southeast, southwest, or smart for content-aware cropping)",
+            Value:    "center",
+          },
+          &cli.StringFlag{
+            Name:     "background",
+            Aliases:  []string{ "b" },
+            Usage:    "background color for padding and rotated corners (hex such as #ffffff, rgb(r,g,b), " +
+                      "rgba(r,g,b,a), or transparent)",
+            Value:    "transparent",
+          },
+          &cli.StringFlag{
+            Name:     "scale",
+            Aliases:  []string{ "s" },
+            Usage:    "scale by a factor or percentage (0.5, 2x, or 50%) instead of width and height",
+          },
+          &cli.StringFlag{
+            Name:     "max-pixels",
+            Usage:    "maximum total pixel count (such as 1150000 or 1.15mp)",
+          },
+          &cli.IntFlag{
+            Name:     "max-long-edge",
+            Usage:    "maximum length of the longer side in pixels",
+          },
+          &cli.IntFlag{
+            Name:     "max-short-edge",
+            Usage:    "maximum length of the shorter side in pixels",
+          },
+          &cli.StringFlag{
+            Name:     "protect",
+            Usage:    "mask image whose light areas are preserved by seam carving",
+          },
         },
         Action: transformImageCommand,
       },
@@ -143,27 +373,92 @@ func main() {
       {
         Name:         "clip",
         Usage:        "Extract a rectangular region from an image",
-        UsageText:    "imgr clip [options] <input> <output>",
+        UsageText:    "imgr clip [options] <input> <output>\n" +
+                      "   imgr clip --regions <file> [options] <input> <output-template>",
         Flags: []cli.Flag{
           &cli.IntFlag{
             Name:       "x1",
             Usage:      "left edge x coordinate",
-            Required:   true,
           },
           &cli.IntFlag{
             Name:       "y1",
             Usage:      "top edge y coordinate",
-            Required:   true,
           },
           &cli.IntFlag{
             Name:       "x2",
             Usage:      "right edge x coordinate",
-            Required:   true,
           },
           &cli.IntFlag{
             Name:       "y2",
             Usage:      "bottom edge y coordinate",
-            Required:   true,
+          },
+          &cli.StringFlag{
+            Name:       "mode",
+            Aliases:    []string{ "m" },
+            Usage:      "how the region is chosen (rect for explicit coordinates, smart for content-aware)",
+            Value:      "rect",
+          },
+          &cli.StringFlag{
+            Name:       "aspect",
+            Aliases:    []string{ "a" },
+            Usage:      "clip the largest region with this aspect ratio (such as 16:9, 1:1, or 1.5), " +
+                        "placed by the gravity or by content with smart",
+          },
+          &cli.StringFlag{
+            Name:       "x",
+            Usage:      "left edge in pixels or percent (negative counts from the right edge), " +
+                        "or the shift from the gravity position",
+          },
+          &cli.StringFlag{
+            Name:       "y",
+            Usage:      "top edge in pixels or percent (negative counts from the bottom edge), " +
+                        "or the shift from the gravity position",
+          },
+          &cli.StringFlag{
+            Name:       "width",
+            Aliases:    []string{ "w" },
+            Usage:      "region width in pixels or percent of the image width (default: the rest of the image)",
+          },
+          &cli.StringFlag{
+            Name:       "height",
+            Aliases:    []string{ "h" },
+            Usage:      "region height in pixels or percent of the image height (default: the rest of the image)",
+          },
+          &cli.StringFlag{
+            Name:       "gravity",
+            Aliases:    []string{ "g" },
+            Usage:      "anchor the region to the image (center, north, south, east, west, northeast, " +
+                        "northwest, southeast, southwest, or smart with --aspect)",
+          },
+          &cli.StringFlag{
+            Name:       "ellipse",
+            Usage:      "clip the ellipse cx,cy,rx,ry (or the circle cx,cy,r), leaving the outside transparent",
+          },
+          &cli.StringFlag{
+            Name:       "polygon",
+            Usage:      "clip the polygon x,y;x,y;x,y;..., leaving the outside transparent",
+          },
+          &cli.StringFlag{
+            Name:       "overflow",
+            Usage:      "regions reaching past the image edges are an error, clamped to the image (clamp), " +
+                        "or padded with the background (pad)",
+            Value:      "error",
+          },
+          &cli.StringFlag{
+            Name:       "background",
+            Aliases:    []string{ "b" },
+            Usage:      "color outside a shape and for the pad overflow mode (hex such as #ffffff, rgb(r,g,b), " +
+                        "rgba(r,g,b,a), or transparent)",
+            Value:      "transparent",
+          },
+          &cli.StringFlag{
+            Name:       "regions",
+            Usage:      "JSON or CSV file of named regions (name, x1, y1, x2, y2) to clip in one pass; " +
+                        "the output is then a file name template using {name} and {index}",
+          },
+          &cli.IntFlag{
+            Name:       "depth",
+            Usage:      "output bits per channel (8 or 16, default keeps the source depth)",
           },
           &cli.IntFlag{
             Name:     "quality",
@@ -174,6 +469,283 @@ func main() {
         },
         Action: clipImageCommand,
       },
+      {
+        Name:         "trim",
+        Usage:        "Remove uniform borders and report the content bounding box",
+        UsageText:    "imgr trim [options] <input> [output]",
+        Flags: []cli.Flag{
+          &cli.StringFlag{
+            Name:       "fuzz",
+            Usage:      "color tolerance, as a percentage of the largest possible difference (such as 5%)",
+            Value:      "0",
+          },
+          &cli.IntFlag{
+            Name:       "quality",
+            Aliases:    []string{ "q" },
+            Usage:      "JPEG quality (0-100)",
+            Value:      90,
+          },
+        },
+        Action: trimImageCommand,
+      },
+      {
+        Name:         "tile",
+        Usage:        "Split an image into a grid or into fixed-size tiles",
+        UsageText:    "imgr tile [options] <input> <output-template>",
+        Flags: []cli.Flag{
+          &cli.IntFlag{
+            Name:       "rows",
+            Usage:      "number of tile rows (grid)",
+          },
+          &cli.IntFlag{
+            Name:       "columns",
+            Aliases:    []string{ "cols" },
+            Usage:      "number of tile columns (grid)",
+          },
+          &cli.IntFlag{
+            Name:       "width",
+            Aliases:    []string{ "w" },
+            Usage:      "tile width in pixels (fixed-size tiles)",
+          },
+          &cli.IntFlag{
+            Name:       "height",
+            Aliases:    []string{ "h" },
+            Usage:      "tile height in pixels (fixed-size tiles)",
+          },
+          &cli.IntFlag{
+            Name:       "overlap",
+            Usage:      "pixels shared by neighbouring tiles",
+          },
+          &cli.StringFlag{
+            Name:       "edge",
+            Usage:      "tiles cut short by the image edge are kept (partial), padded to full size (pad), " +
+                        "or left out (drop); fixed-size tiles only",
+            Value:      "partial",
+          },
+          &cli.StringFlag{
+            Name:       "background",
+            Aliases:    []string{ "b" },
+            Usage:      "padding color for the pad edge mode (hex such as #ffffff, rgb(r,g,b), " +
+                        "rgba(r,g,b,a), or transparent)",
+            Value:      "transparent",
+          },
+          &cli.IntFlag{
+            Name:       "quality",
+            Aliases:    []string{ "q" },
+            Usage:      "JPEG quality (0-100)",
+            Value:      90,
+          },
+        },
+        Action: tileImageCommand,
+      },
+      {
+        Name:         "sprites",
+        Usage:        "Find the separate sprites on a sheet and extract each to its own file",
+        UsageText:    "imgr sprites [options] <input> [output-template]",
+        Flags: []cli.Flag{
+          &cli.StringFlag{
+            Name:       "background",
+            Aliases:    []string{ "b" },
+            Usage:      "color around the sprites: auto (taken from the corners), transparent, or a color " +
+                        "(hex such as #ffffff, rgb(r,g,b), or rgba(r,g,b,a))",
+            Value:      "auto",
+          },
+          &cli.StringFlag{
+            Name:       "fuzz",
+            Usage:      "color tolerance, as a percentage of the largest possible difference (such as 5%)",
+            Value:      "0",
+          },
+          &cli.IntFlag{
+            Name:       "connectivity",
+            Usage:      "pixels touching on 4 sides, or also diagonally (8), belong to the same sprite",
+            Value:      8,
+          },
+          &cli.IntFlag{
+            Name:       "min-area",
+            Usage:      "smallest number of pixels in a sprite; smaller specks are left out",
+            Value:      1,
+          },
+          &cli.IntFlag{
+            Name:       "padding",
+            Usage:      "pixels of margin added around each sprite, within the image (up to 65535)",
+          },
+          &cli.IntFlag{
+            Name:       "quality",
+            Aliases:    []string{ "q" },
+            Usage:      "JPEG quality (0-100)",
+            Value:      90,
+          },
+        },
+        Action: spritesImageCommand,
+      },
+      {
+        Name:         "deskew",
+        Usage:        "Detect and correct the skew of a scanned document",
+        UsageText:    "imgr deskew [options] <input> <output>",
+        Flags: []cli.Flag{
+          &cli.Float64Flag{
+            Name:       "max-angle",
+            Usage:      "largest skew in degrees to look for in either direction (up to 45)",
+            Value:      15,
+          },
+          &cli.BoolFlag{
+            Name:       "expand",
+            Usage:      "grow the canvas to fit the whole rotated image instead of keeping the original size",
+          },
+          &cli.StringFlag{
+            Name:       "background",
+            Aliases:    []string{ "b" },
+            Usage:      "color for the uncovered corners (auto for the detected page color, hex such as " +
+                        "#ffffff, rgb(r,g,b), rgba(r,g,b,a), or transparent)",
+            Value:      "auto",
+          },
+          &cli.StringFlag{
+            Name:       "filter",
+            Usage:      "resampling filter (nearest, bilinear, catmull-rom, lanczos3, or box)",
+            Value:      "bilinear",
+          },
+          &cli.IntFlag{
+            Name:       "quality",
+            Aliases:    []string{ "q" },
+            Usage:      "JPEG quality (0-100)",
+            Value:      90,
+          },
+        },
+        Action: deskewImageCommand,
+      },
+      {
+        Name:         "perspective",
+        Usage:        "Warp a quadrilateral region onto a rectangle",
+        UsageText:    "imgr perspective --x1 X --y1 Y ... --x4 X --y4 Y [options] <input> <output>",
+        Flags: []cli.Flag{
+          &cli.Float64Flag{
+            Name:       "x1",
+            Usage:      "top left corner x coordinate",
+          },
+          &cli.Float64Flag{
+            Name:       "y1",
+            Usage:      "top left corner y coordinate",
+          },
+          &cli.Float64Flag{
+            Name:       "x2",
+            Usage:      "top right corner x coordinate",
+          },
+          &cli.Float64Flag{
+            Name:       "y2",
+            Usage:      "top right corner y coordinate",
+          },
+          &cli.Float64Flag{
+            Name:       "x3",
+            Usage:      "bottom right corner x coordinate",
+          },
+          &cli.Float64Flag{
+            Name:       "y3",
+            Usage:      "bottom right corner y coordinate",
+          },
+          &cli.Float64Flag{
+            Name:       "x4",
+            Usage:      "bottom left corner x coordinate",
+          },
+          &cli.Float64Flag{
+            Name:       "y4",
+            Usage:      "bottom left corner y coordinate",
+          },
+          &cli.IntFlag{
+            Name:       "width",
+            Aliases:    []string{ "w" },
+            Usage:      "output width in pixels (default: inferred from the corners)",
+          },
+          &cli.IntFlag{
+            Name:       "height",
+            Aliases:    []string{ "h" },
+            Usage:      "output height in pixels (default: inferred from the corners)",
+          },
+          &cli.StringFlag{
+            Name:       "filter",
+            Usage:      "sampling filter (nearest, bilinear, or catmull-rom for bicubic)",
+            Value:      "bilinear",
+          },
+          &cli.StringFlag{
+            Name:       "background",
+            Aliases:    []string{ "b" },
+            Usage:      "color for areas outside the image (hex such as #ffffff, rgb(r,g,b), " +
+                        "rgba(r,g,b,a), or transparent)",
+            Value:      "transparent",
+          },
+          &cli.IntFlag{
+            Name:       "threads",
+            Usage:      "number of goroutines used for sampling (default: GOMAXPROCS)",
+          },
+          &cli.IntFlag{
+            Name:       "quality",
+            Aliases:    []string{ "q" },
+            Usage:      "JPEG quality (0-100)",
+            Value:      90,
+          },
+        },
+        Action: perspectiveImageCommand,
+      },
+      {
+        Name:         "affine",
+        Usage:        "Apply an affine transform (a matrix, or translate, scale, shear, and rotate)",
+        UsageText:    "imgr affine [options] <input> <output>",
+        Flags: []cli.Flag{
+          &cli.StringFlag{
+            Name:       "matrix",
+            Usage:      "six numbers a,b,c,d,e,f mapping x,y to a*x+b*y+c, d*x+e*y+f",
+          },
+          &cli.StringFlag{
+            Name:       "translate",
+            Usage:      "offset tx,ty in pixels, applied last",
+          },
+          &cli.StringFlag{
+            Name:       "scale",
+            Aliases:    []string{ "s" },
+            Usage:      "scale factor, or sx,sy for each axis, applied first",
+          },
+          &cli.StringFlag{
+            Name:       "shear",
+            Usage:      "shear angle in degrees along x, or x,y for both axes",
+          },
+          &cli.Float64Flag{
+            Name:       "rotate",
+            Aliases:    []string{ "r" },
+            Usage:      "clockwise rotation in degrees about the image origin",
+          },
+          &cli.IntFlag{
+            Name:       "width",
+            Aliases:    []string{ "w" },
+            Usage:      "output width in pixels (default: input width)",
+          },
+          &cli.IntFlag{
+            Name:       "height",
+            Aliases:    []string{ "h" },
+            Usage:      "output height in pixels (default: input height)",
+          },
+          &cli.BoolFlag{
+            Name:       "expand",
+            Usage:      "size the output to fit the whole transformed image, shifting it into view",
+          },
+          &cli.StringFlag{
+            Name:       "filter",
+            Usage:      "resampling filter (nearest, bilinear, catmull-rom, lanczos3, or box)",
+            Value:      "bilinear",
+          },
+          &cli.StringFlag{
+            Name:       "background",
+            Aliases:    []string{ "b" },
+            Usage:      "color for uncovered areas (hex such as #ffffff, rgb(r,g,b), rgba(r,g,b,a), or transparent)",
+            Value:      "transparent",
+          },
+          &cli.IntFlag{
+            Name:       "quality",
+            Aliases:    []string{ "q" },
+            Usage:      "JPEG quality (0-100)",
+            Value:      90,
+          },
+        },
+        Action: affineImageCommand,
+      },
     },
   }
 
@@ -209,19 +781,49 @@ func outputSuccess( data interface{}, useJSON bool ) {
 }
 
 func loadImage( path string ) ( image.Image, string, error ) {
+  img, format, _, err := loadOrientedImage( path, true )
+  return img, format, err
+}
+
+// loadOrientedImage decodes the image and reports its stored orientation ( the EXIF
+// values 1 to 8 ). with autoOrient the pixels are turned upright, otherwise they are
+// returned as stored in the file
+func loadOrientedImage( path string, autoOrient bool ) ( image.Image, string, int, error ) {
   extension := strings.ToLower( filepath.Ext( path ) )
 
+  data, err := os.ReadFile( path )
+  if err != nil {
+    return nil, "", 0, err
+  }
+
   if extension == ".heic" || extension == ".heif" || extension == ".avif" {
-    return decodeHeif( path )
+    img, format, err := decodeHeif( path )
+    if err != nil {
+      return nil, "", 0, err
+    }
+
+    // libheif always applies irot and imir, so undo them when asked not to orient
+    applied := heifOrientation( data )
+    if !autoOrient {
+      img = orientImage( img, applied.inverse() )
+    }
+    return img, format, orientationNumber( applied ), nil
   }
 
-  inputFile, err := os.Open( path )
+  img, format, err := image.Decode( bytes.NewReader( data ) )
   if err != nil {
-    return nil, "", err
+    return nil, "", 0, err
+  }
+
+  number := 1
+  if format == "jpeg" {
+    number = jpegOrientation( data )
   }
-  defer inputFile.Close()
 
-  return image.Decode( inputFile )
+  if autoOrient {
+    img = orientImage( img, exifOrientations[ number ] )
+  }
+  return img, format, number, nil
 }
 
 func decodeHeif( path string ) ( image.Image, string, error ) {
@@ -253,248 +855,4268 @@ func decodeHeif( path string ) ( image.Image, string, error ) {
   return goImage, "heif", nil
 }
 
-func rotateImage( img image.Image, degrees int ) image.Image {
-  bounds := img.Bounds()
-  width := bounds.Dx()
-  height := bounds.Dy()
+// jpegOrientation finds the EXIF orientation tag in the APP1 segment of a JPEG file,
+// returning 1 ( upright ) when there is none
+func jpegOrientation( data []byte ) int {
+  if len( data ) < 4 || data[ 0 ] != 0xff || data[ 1 ] != 0xd8 {
+    return 1
+  }
 
-  switch degrees {
-  case 90:
-    rotated := image.NewRGBA( image.Rect( 0, 0, height, width ) )
-    for y := 0; y < height; y++ {
-      for x := 0; x < width; x++ {
-        rotated.Set( height-1-y, x, img.At( x+bounds.Min.X, y+bounds.Min.Y ) )
-      }
+  offset := 2
+  for offset + 4 <= len( data ) {
+    if data[ offset ] != 0xff {
+      return 1
     }
-    return rotated
 
-  case 180:
-    rotated := image.NewRGBA( image.Rect( 0, 0, width, height ) )
-    for y := 0; y < height; y++ {
-      for x := 0; x < width; x++ {
-        rotated.Set( width-1-x, height-1-y, img.At( x+bounds.Min.X, y+bounds.Min.Y ) )
-      }
+    marker := data[ offset + 1 ]
+    switch {
+    case marker == 0xff:
+      // fill byte before a marker
+      offset++
+      continue
+    case marker == 0xd9 || marker == 0xda:
+      // the metadata segments all come before the image data
+      return 1
+    case marker == 0x01 || ( marker >= 0xd0 && marker <= 0xd7 ):
+      offset += 2
+      continue
     }
-    return rotated
 
-  case 270:
-    rotated := image.NewRGBA( image.Rect( 0, 0, height, width ) )
-    for y := 0; y < height; y++ {
-      for x := 0; x < width; x++ {
-        rotated.Set( y, width-1-x, img.At( x+bounds.Min.X, y+bounds.Min.Y ) )
+    length := int( binary.BigEndian.Uint16( data[ offset + 2: ] ) )
+    if length < 2 || offset + 2 + length > len( data ) {
+      return 1
+    }
+
+    segment := data[ offset + 4 : offset + 2 + length ]
+    if marker == 0xe1 && len( segment ) > 6 && string( segment[ :6 ] ) == "Exif\x00\x00" {
+      if number := exifOrientation( segment[ 6: ] ); number != 0 {
+        return number
       }
     }
-    return rotated
 
-  default:
-    return img
+    offset += 2 + length
   }
+
+  return 1
 }
 
-func transformImageCommand( context *cli.Context ) error {
-  useJSON := context.Bool( "json" )
-  result, err := transformImage( context )
+// exifOrientation reads the orientation tag ( 0x0112 ) from the first IFD of the TIFF
+// structure inside an EXIF segment, returning 0 when it is missing or invalid
+func exifOrientation( data []byte ) int {
+  if len( data ) < 8 {
+    return 0
+  }
 
-  if err != nil {
-    outputError( err.Error(), useJSON )
-    return err
+  var order binary.ByteOrder
+  switch string( data[ :2 ] ) {
+  case "II":
+    order = binary.LittleEndian
+  case "MM":
+    order = binary.BigEndian
+  default:
+    return 0
   }
 
-  if useJSON {
-    outputSuccess( result, useJSON )
-  } else {
-    fmt.Println( result.Message )
-    fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+  ifd := int64( order.Uint32( data[ 4: ] ) )
+  if ifd + 2 > int64( len( data ) ) {
+    return 0
   }
 
-  return nil
-}
+  count := int( order.Uint16( data[ ifd: ] ) )
+  for i := 0; i < count; i++ {
+    entry := ifd + 2 + int64( i ) * 12
+    if entry + 12 > int64( len( data ) ) {
+      return 0
+    }
 
-func transformImage( context *cli.Context ) ( *TransformResult, error ) {
-  if context.NArg() != 2 {
-    return nil, fmt.Errorf( "Expected 2 arguments (input and output), but got %d.", context.NArg() )
+    if order.Uint16( data[ entry: ] ) == 0x0112 {
+      value := int( order.Uint16( data[ entry + 8: ] ) )
+      if value < 1 || value > 8 {
+        return 0
+      }
+      return value
+    }
   }
 
-  inputPath := context.Args().Get( 0 )
-  outputPath := context.Args().Get( 1 )
-  maxWidth := context.Int( "width" )
-  maxHeight := context.Int( "height" )
-  quality := context.Int( "quality" )
-  noEnlarge := context.Bool( "no-enlarge" )
-  rotate := context.Int( "rotate" )
+  return 0
+}
 
-  if rotate != 0 && rotate != 90 && rotate != 180 && rotate != 270 {
-    return nil, fmt.Errorf( "Rotation must be 0, 90, 180, or 270 degrees, but got %d.", rotate )
+// heifOrientation returns the combined irot and imir transformations that libheif
+// applies to the primary item when decoding
+func heifOrientation( data []byte ) orientation {
+  meta := findHeifBox( splitHeifBoxes( data ), "meta" )
+  if len( meta ) < 4 {
+    return identityOrientation
   }
 
-  if maxWidth < 0 {
-    return nil, fmt.Errorf( "Width cannot be negative, but got %d.", maxWidth )
+  // meta, pitm and ipma are full boxes with a version and flags before their contents
+  metaBoxes := splitHeifBoxes( meta[ 4: ] )
+  pitm := findHeifBox( metaBoxes, "pitm" )
+  var primary uint32
+  switch {
+  case len( pitm ) >= 6 && pitm[ 0 ] == 0:
+    primary = uint32( binary.BigEndian.Uint16( pitm[ 4: ] ) )
+  case len( pitm ) >= 8:
+    primary = binary.BigEndian.Uint32( pitm[ 4: ] )
+  default:
+    return identityOrientation
   }
 
-  if maxHeight < 0 {
-    return nil, fmt.Errorf( "Height cannot be negative, but got %d.", maxHeight )
+  iprp := splitHeifBoxes( findHeifBox( metaBoxes, "iprp" ) )
+  properties := splitHeifBoxes( findHeifBox( iprp, "ipco" ) )
+  ipma := findHeifBox( iprp, "ipma" )
+  if len( ipma ) < 8 {
+    return identityOrientation
   }
 
-  if quality < 0 || quality > 100 {
-    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
-  }
+  version := ipma[ 0 ]
+  wideIndex := ipma[ 3 ] & 1 == 1
+  entries := binary.BigEndian.Uint32( ipma[ 4: ] )
+  position := 8
 
-  sourceImage, format, err := loadImage( inputPath )
-  if err != nil {
-    return nil, fmt.Errorf( "The image file %s could not be decoded (possibly corrupt or unsupported format): %w",
-      inputPath, err )
-  }
+  result := identityOrientation
+  for entry := uint32( 0 ); entry < entries; entry++ {
+    var item uint32
+    if version < 1 {
+      if position + 2 > len( ipma ) {
+        break
+      }
+      item = uint32( binary.BigEndian.Uint16( ipma[ position: ] ) )
+      position += 2
+    } else {
+      if position + 4 > len( ipma ) {
+        break
+      }
+      item = binary.BigEndian.Uint32( ipma[ position: ] )
+      position += 4
+    }
 
-  if sourceImage == nil {
-    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
-  }
+    if position >= len( ipma ) {
+      break
+    }
+    associations := int( ipma[ position ] )
+    position++
 
-  // apply rotation before resizing
-  if rotate != 0 {
-    sourceImage = rotateImage( sourceImage, rotate )
-  }
+    for association := 0; association < associations; association++ {
+      var index int
+      if wideIndex {
+        if position + 2 > len( ipma ) {
+          return result
+        }
+        index = int( binary.BigEndian.Uint16( ipma[ position: ] ) & 0x7fff )
+        position += 2
+      } else {
+        if position >= len( ipma ) {
+          return result
+        }
+        index = int( ipma[ position ] & 0x7f )
+        position++
+      }
 
-  bounds := sourceImage.Bounds()
-  originalWidth := bounds.Dx()
-  originalHeight := bounds.Dy()
+      // property indices start at 1, zero means no property
+      if item != primary || index < 1 || index > len( properties ) {
+        continue
+      }
 
-  if originalWidth <= 0 || originalHeight <= 0 {
-    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
-      inputPath, originalWidth, originalHeight )
+      property := properties[ index - 1 ]
+      if len( property.Data ) < 1 {
+        continue
+      }
+
+      switch property.Type {
+      case "irot":
+        // rotation is counter-clockwise in steps of 90 degrees
+        result = result.then( rotationOrientation( ( 4 - int( property.Data[ 0 ] & 3 ) ) % 4 * 90 ) )
+      case "imir":
+        // libheif mirrors left to right for axis 1 and top to bottom for axis 0
+        if property.Data[ 0 ] & 1 == 1 {
+          result = result.then( flopOrientation )
+        } else {
+          result = result.then( flipOrientation )
+        }
+      }
+    }
   }
 
-  const maxDimension = 65535
-  if originalWidth > maxDimension || originalHeight > maxDimension {
-    return nil, fmt.Errorf( "The image %s is too large: %dx%d (maximum dimension is %d).",
-      inputPath, originalWidth, originalHeight, maxDimension )
+  return result
+}
+
+type heifBox struct {
+  Type                  string
+  Data                  []byte
+}
+
+// splitHeifBoxes splits ISOBMFF data into its boxes, in order since the position of
+// each property in ipco matters
+func splitHeifBoxes( data []byte ) []heifBox {
+  var boxes []heifBox
+  for len( data ) >= 8 {
+    size := uint64( binary.BigEndian.Uint32( data ) )
+    header := uint64( 8 )
+
+    switch size {
+    case 0:
+      size = uint64( len( data ) )
+    case 1:
+      if len( data ) < 16 {
+        return boxes
+      }
+      size = binary.BigEndian.Uint64( data[ 8: ] )
+      header = 16
+    }
+
+    if size < header || size > uint64( len( data ) ) {
+      return boxes
+    }
+
+    boxes = append( boxes, heifBox{ Type: string( data[ 4:8 ] ), Data: data[ header:size ] } )
+    data = data[ size: ]
   }
 
-  var destinationImage image.Image
-  var targetWidth, targetHeight int
-  var resized bool
-  var message string
+  return boxes
+}
 
-  if maxWidth == 0 && maxHeight == 0 {
-    message = fmt.Sprintf( "Converting %s [%s] %dx%d (no resize)",
-      filepath.Base( inputPath ),
-      format,
-      originalWidth,
-      originalHeight,
-    )
-    destinationImage = sourceImage
-    targetWidth = originalWidth
-    targetHeight = originalHeight
-    resized = false
-  } else {
-    targetWidth = maxWidth
-    targetHeight = maxHeight
-
-    if maxWidth == 0 && maxHeight > 0 {
-      aspectRatio := float64( originalWidth ) / float64( originalHeight )
-      targetWidth = int( float64( targetHeight ) * aspectRatio + 0.5 )
-    } else if maxHeight == 0 && maxWidth > 0 {
-      aspectRatio := float64( originalHeight ) / float64( originalWidth )
-      targetHeight = int( float64( targetWidth ) * aspectRatio + 0.5 )
-    } else {
-      originalAspect := float64( originalWidth ) / float64( originalHeight )
-      targetAspect := float64( maxWidth ) / float64( maxHeight )
+func findHeifBox( boxes []heifBox, boxType string ) []byte {
+  for _, box := range boxes {
+    if box.Type == boxType {
+      return box.Data
+    }
+  }
+  return nil
+}
 
-      if originalAspect > targetAspect {
-        targetWidth = maxWidth
-        targetHeight = int( float64( maxWidth ) / originalAspect + 0.5 )
-      } else {
-        targetHeight = maxHeight
-        targetWidth = int( float64( maxHeight ) * originalAspect + 0.5 )
+// orientation is one of the eight right-angle rotations and mirrors, as the integer
+// matrix mapping source pixel offsets to destination offsets
+type orientation struct {
+  A, B, C, D            int
+}
+
+var (
+  identityOrientation   = orientation{ 1, 0, 0, 1 }
+  flipOrientation       = orientation{ 1, 0, 0, -1 }
+  flopOrientation       = orientation{ -1, 0, 0, 1 }
+  transposeOrientation  = orientation{ 0, 1, 1, 0 }
+  transverseOrientation = orientation{ 0, -1, -1, 0 }
+)
+
+// exifOrientations maps the EXIF orientation values to the orientation that turns the
+// stored pixels upright
+var exifOrientations = [ 9 ]orientation{
+  1: identityOrientation,
+  2: flopOrientation,
+  3: { -1, 0, 0, -1 },
+  4: flipOrientation,
+  5: transposeOrientation,
+  6: { 0, -1, 1, 0 },
+  7: transverseOrientation,
+  8: { 0, 1, -1, 0 },
+}
+
+func orientationNumber( o orientation ) int {
+  for number := 1; number < len( exifOrientations ); number++ {
+    if exifOrientations[ number ] == o {
+      return number
+    }
+  }
+  return 1
+}
+
+func rotationOrientation( degrees int ) orientation {
+  switch degrees {
+  case 90:
+    return orientation{ 0, -1, 1, 0 }
+  case 180:
+    return orientation{ -1, 0, 0, -1 }
+  case 270:
+    return orientation{ 0, 1, -1, 0 }
+  }
+  return identityOrientation
+}
+
+// then returns the orientation that applies o followed by next
+func ( o orientation ) then( next orientation ) orientation {
+  return orientation{
+    A: next.A * o.A + next.B * o.C,
+    B: next.A * o.B + next.B * o.D,
+    C: next.C * o.A + next.D * o.C,
+    D: next.C * o.B + next.D * o.D,
+  }
+}
+
+// inverse returns the orientation that undoes o ( the matrices are orthogonal )
+func ( o orientation ) inverse() orientation {
+  return orientation{ A: o.A, B: o.C, C: o.B, D: o.D }
+}
+
+func rotateImage( img image.Image, degrees int ) image.Image {
+  return orientImage( img, rotationOrientation( degrees ) )
+}
+
+// orientImage applies a combination of right-angle rotations and mirrors in a single
+// exact pixel copy
+func orientImage( img image.Image, o orientation ) image.Image {
+  if o == identityOrientation {
+    return img
+  }
+
+  bounds := img.Bounds()
+  width, height, offsetX, offsetY := o.placement( bounds.Dx(), bounds.Dy() )
+  oriented := newCanvas( img, image.Rect( 0, 0, width, height ), true )
+
+  sourcePix, sourceStride, bytesPerPixel, sourceOk := pixelLayout( img )
+  destinationPix, destinationStride, destinationBytes, destinationOk := pixelLayout( oriented )
+  ycbcr, isYCbCr := img.( *image.YCbCr )
+  rgba, isRGBA := oriented.( *image.RGBA )
+
+  switch {
+  case sourceOk && destinationOk && bytesPerPixel == destinationBytes:
+    orientPixels( destinationPix, destinationStride, sourcePix, sourceStride, bounds.Dx(), bounds.Dy(),
+      bytesPerPixel, o, offsetX, offsetY )
+  case isYCbCr && isRGBA:
+    orientYCbCr( rgba, ycbcr, o, offsetX, offsetY )
+  default:
+    orientGeneric( oriented, img, o, offsetX, offsetY )
+  }
+
+  return oriented
+}
+
+// placement returns the size of a width x height image after applying the orientation,
+// and the offsets that move the mirrored coordinates back into the positive range
+func ( o orientation ) placement( width int, height int ) ( int, int, int, int ) {
+  outputWidth := abs( o.A ) * width + abs( o.B ) * height
+  outputHeight := abs( o.C ) * width + abs( o.D ) * height
+  offsetX := max( 0, -o.A ) * ( width - 1 ) + max( 0, -o.B ) * ( height - 1 )
+  offsetY := max( 0, -o.C ) * ( width - 1 ) + max( 0, -o.D ) * ( height - 1 )
+  return outputWidth, outputHeight, offsetX, offsetY
+}
+
+// pixelLayout exposes the pixel buffer of the image types that newCanvas preserves and
+// that store each pixel as consecutive bytes, so pixels can be copied without converting
+func pixelLayout( img image.Image ) ( []uint8, int, int, bool ) {
+  switch typed := img.( type ) {
+  case *image.RGBA:
+    return typed.Pix, typed.Stride, 4, true
+  case *image.NRGBA:
+    return typed.Pix, typed.Stride, 4, true
+  case *image.RGBA64:
+    return typed.Pix, typed.Stride, 8, true
+  case *image.NRGBA64:
+    return typed.Pix, typed.Stride, 8, true
+  case *image.Gray:
+    return typed.Pix, typed.Stride, 1, true
+  case *image.Gray16:
+    return typed.Pix, typed.Stride, 2, true
+  case *image.Paletted:
+    return typed.Pix, typed.Stride, 1, true
+  }
+  return nil, 0, 0, false
+}
+
+// orientBlock is the side of the square tiles the orientation loops walk through, so
+// that both the rows read and the columns written stay in cache
+const orientBlock = 64
+
+func orientPixels( destination []uint8, destinationStride int, source []uint8, sourceStride int,
+  width int, height int, bytesPerPixel int, o orientation, offsetX int, offsetY int ) {
+  // moving one pixel right in the source moves this far in the destination
+  step := o.A * bytesPerPixel + o.C * destinationStride
+
+  for blockY := 0; blockY < height; blockY += orientBlock {
+    blockHeight := min( orientBlock, height - blockY )
+    for blockX := 0; blockX < width; blockX += orientBlock {
+      blockWidth := min( orientBlock, width - blockX )
+
+      for y := blockY; y < blockY + blockHeight; y++ {
+        sourceOffset := y * sourceStride + blockX * bytesPerPixel
+        destinationOffset := ( o.A * blockX + o.B * y + offsetX ) * bytesPerPixel +
+          ( o.C * blockX + o.D * y + offsetY ) * destinationStride
+
+        switch bytesPerPixel {
+        case 1:
+          for x := 0; x < blockWidth; x++ {
+            destination[ destinationOffset ] = source[ sourceOffset ]
+            sourceOffset++
+            destinationOffset += step
+          }
+        case 4:
+          for x := 0; x < blockWidth; x++ {
+            pixel := source[ sourceOffset : sourceOffset + 4 : sourceOffset + 4 ]
+            target := destination[ destinationOffset : destinationOffset + 4 : destinationOffset + 4 ]
+            target[ 0 ], target[ 1 ], target[ 2 ], target[ 3 ] = pixel[ 0 ], pixel[ 1 ], pixel[ 2 ], pixel[ 3 ]
+            sourceOffset += 4
+            destinationOffset += step
+          }
+        default:
+          for x := 0; x < blockWidth; x++ {
+            copy( destination[ destinationOffset : destinationOffset + bytesPerPixel ],
+              source[ sourceOffset : sourceOffset + bytesPerPixel ] )
+            sourceOffset += bytesPerPixel
+            destinationOffset += step
+          }
+        }
       }
     }
+  }
+}
 
-    if noEnlarge {
-      if targetWidth > originalWidth || targetHeight > originalHeight {
-        targetWidth = originalWidth
-        targetHeight = originalHeight
+// orientYCbCr converts to RGBA while orienting, reading the Y, Cb and Cr planes directly
+func orientYCbCr( destination *image.RGBA, source *image.YCbCr, o orientation, offsetX int, offsetY int ) {
+  bounds := source.Bounds()
+  width := bounds.Dx()
+  height := bounds.Dy()
+  step := o.A * 4 + o.C * destination.Stride
+
+  for blockY := 0; blockY < height; blockY += orientBlock {
+    blockHeight := min( orientBlock, height - blockY )
+    for blockX := 0; blockX < width; blockX += orientBlock {
+      blockWidth := min( orientBlock, width - blockX )
+
+      for y := blockY; y < blockY + blockHeight; y++ {
+        destinationOffset := ( o.A * blockX + o.B * y + offsetX ) * 4 +
+          ( o.C * blockX + o.D * y + offsetY ) * destination.Stride
+
+        for x := blockX; x < blockX + blockWidth; x++ {
+          lumaOffset := source.YOffset( x + bounds.Min.X, y + bounds.Min.Y )
+          chromaOffset := source.COffset( x + bounds.Min.X, y + bounds.Min.Y )
+          r, g, b := color.YCbCrToRGB( source.Y[ lumaOffset ], source.Cb[ chromaOffset ], source.Cr[ chromaOffset ] )
+
+          target := destination.Pix[ destinationOffset : destinationOffset + 4 : destinationOffset + 4 ]
+          target[ 0 ], target[ 1 ], target[ 2 ], target[ 3 ] = r, g, b, 0xff
+          destinationOffset += step
+        }
       }
     }
+  }
+}
 
-    if targetWidth <= 0 || targetHeight <= 0 {
-      return nil, fmt.Errorf( "Calculated target dimensions are invalid: %dx%d.",
-        targetWidth, targetHeight )
+// orientGeneric is the fallback for any image type, going through At and Set
+func orientGeneric( destination draw.Image, source image.Image, o orientation, offsetX int, offsetY int ) {
+  bounds := source.Bounds()
+  for y := 0; y < bounds.Dy(); y++ {
+    for x := 0; x < bounds.Dx(); x++ {
+      destination.Set( o.A * x + o.B * y + offsetX, o.C * x + o.D * y + offsetY, source.At( x+bounds.Min.X, y+bounds.Min.Y ) )
     }
+  }
+}
 
-    if targetWidth > maxDimension || targetHeight > maxDimension {
-      return nil, fmt.Errorf( "Target dimensions %dx%d exceed maximum dimension of %d.",
-        targetWidth, targetHeight, maxDimension )
+// cropImage copies the rectangle ( in image coordinates, limited to the image ) into a
+// new image with its origin at zero, copying whole rows when the pixel layout allows it
+func cropImage( img image.Image, rect image.Rectangle ) image.Image {
+  rect = rect.Intersect( img.Bounds() )
+  cropped := newCanvas( img, image.Rect( 0, 0, rect.Dx(), rect.Dy() ), true )
+
+  sourcePix, sourceStride, bytesPerPixel, sourceOk := pixelLayout( img )
+  destinationPix, destinationStride, destinationBytes, destinationOk := pixelLayout( cropped )
+  if !sourceOk || !destinationOk || bytesPerPixel != destinationBytes {
+    // image/draw already has a fast path for YCbCr into RGBA
+    draw.Draw( cropped, cropped.Bounds(), img, rect.Min, draw.Src )
+    return cropped
+  }
+
+  bounds := img.Bounds()
+  rowBytes := rect.Dx() * bytesPerPixel
+  sourceOffset := ( rect.Min.Y - bounds.Min.Y ) * sourceStride + ( rect.Min.X - bounds.Min.X ) * bytesPerPixel
+  for y := 0; y < rect.Dy(); y++ {
+    copy( destinationPix[ y * destinationStride : y * destinationStride + rowBytes ],
+      sourcePix[ sourceOffset : sourceOffset + rowBytes ] )
+    sourceOffset += sourceStride
+  }
+
+  return cropped
+}
+
+func abs( value int ) int {
+  if value < 0 {
+    return -value
+  }
+  return value
+}
+
+// normalizeAngle maps any angle in degrees into the range [0, 360)
+func normalizeAngle( degrees float64 ) float64 {
+  degrees = math.Mod( degrees, 360 )
+  if degrees < 0 {
+    degrees += 360
+  }
+  return degrees
+}
+
+// rotateAnyAngle rotates the image clockwise by any angle, using the exact pixel copy
+// of rotateImage for right angles. other angles are sampled with the filter and the
+// uncovered corners are filled with the background; with expand the canvas grows to
+// hold the whole rotated image, otherwise it keeps the source size
+func rotateAnyAngle( img image.Image, degrees float64, expand bool, background color.Color, filter draw.Interpolator ) image.Image {
+  degrees = normalizeAngle( degrees )
+  if math.Mod( degrees, 90 ) == 0 {
+    return rotateImage( img, int( degrees ) )
+  }
+
+  bounds := img.Bounds()
+  width := float64( bounds.Dx() )
+  height := float64( bounds.Dy() )
+  radians := degrees * math.Pi / 180
+  sin, cos := math.Sincos( radians )
+
+  outputWidth, outputHeight := bounds.Dx(), bounds.Dy()
+  if expand {
+    // the small epsilon keeps exact sizes from rounding up a pixel
+    outputWidth = int( math.Ceil( math.Abs( width * cos ) + math.Abs( height * sin ) - 1e-9 ) )
+    outputHeight = int( math.Ceil( math.Abs( width * sin ) + math.Abs( height * cos ) - 1e-9 ) )
+  }
+
+  // map source coordinates to destination coordinates, rotating about the centers
+  sourceX := width / 2
+  sourceY := height / 2
+  centerX := float64( outputWidth ) / 2
+  centerY := float64( outputHeight ) / 2
+  matrix := f64.Aff3{
+    cos, -sin, centerX - ( cos * sourceX - sin * sourceY ),
+    sin, cos, centerY - ( sin * sourceX + cos * sourceY ),
+  }
+
+  return affineImage( img, matrix, outputWidth, outputHeight, background, filter )
+}
+
+// affineImage maps the image onto a width by height canvas filled with the background,
+// using a matrix from source coordinates ( relative to the image origin ) to output
+// coordinates; the matrix must be invertible
+func affineImage( img image.Image, matrix f64.Aff3, width int, height int, background color.Color,
+  filter draw.Interpolator ) image.Image {
+  // surround the source with a transparent pixel so that interpolation softens the
+  // transformed edges into the background instead of leaving them jagged
+  bordered := newBorderedImage( img )
+
+  // draw.Transform works in absolute source coordinates
+  bounds := img.Bounds()
+  matrix[ 2 ] -= matrix[ 0 ] * float64( bounds.Min.X ) + matrix[ 1 ] * float64( bounds.Min.Y )
+  matrix[ 5 ] -= matrix[ 3 ] * float64( bounds.Min.X ) + matrix[ 4 ] * float64( bounds.Min.Y )
+
+  transformed := newBackgroundCanvas( img, image.Rect( 0, 0, width, height ), background )
+  filter.Transform( transformed, matrix, bordered, bordered.Bounds(), draw.Over, nil )
+
+  return transformed
+}
+
+// multiplyAffine returns the matrix applying inner first and then outer
+func multiplyAffine( outer f64.Aff3, inner f64.Aff3 ) f64.Aff3 {
+  return f64.Aff3{
+    outer[ 0 ] * inner[ 0 ] + outer[ 1 ] * inner[ 3 ],
+    outer[ 0 ] * inner[ 1 ] + outer[ 1 ] * inner[ 4 ],
+    outer[ 0 ] * inner[ 2 ] + outer[ 1 ] * inner[ 5 ] + outer[ 2 ],
+    outer[ 3 ] * inner[ 0 ] + outer[ 4 ] * inner[ 3 ],
+    outer[ 3 ] * inner[ 1 ] + outer[ 4 ] * inner[ 4 ],
+    outer[ 3 ] * inner[ 2 ] + outer[ 4 ] * inner[ 5 ] + outer[ 5 ],
+  }
+}
+
+// affineBounds returns the bounding box of a width by height image after the matrix
+func affineBounds( matrix f64.Aff3, width int, height int ) ( float64, float64, float64, float64 ) {
+  minX, minY := math.Inf( 1 ), math.Inf( 1 )
+  maxX, maxY := math.Inf( -1 ), math.Inf( -1 )
+  for _, corner := range [][ 2 ]float64{ { 0, 0 }, { float64( width ), 0 }, { 0, float64( height ) },
+    { float64( width ), float64( height ) } } {
+    x := matrix[ 0 ] * corner[ 0 ] + matrix[ 1 ] * corner[ 1 ] + matrix[ 2 ]
+    y := matrix[ 3 ] * corner[ 0 ] + matrix[ 4 ] * corner[ 1 ] + matrix[ 5 ]
+    minX, minY = math.Min( minX, x ), math.Min( minY, y )
+    maxX, maxY = math.Max( maxX, x ), math.Max( maxY, y )
+  }
+  return minX, minY, maxX, maxY
+}
+
+// parseNumbers reads a list of numbers separated by commas ( or spaces ) with a count
+// between minCount and maxCount
+func parseNumbers( value string, name string, minCount int, maxCount int ) ( []float64, error ) {
+  fields := strings.FieldsFunc( value, func( r rune ) bool {
+    return r == ',' || r == ' '
+  } )
+
+  if len( fields ) < minCount || len( fields ) > maxCount {
+    expected := fmt.Sprintf( "%d", minCount )
+    if maxCount != minCount {
+      expected = fmt.Sprintf( "%d or %d", minCount, maxCount )
     }
+    return nil, fmt.Errorf( "The %s %s is not valid (expected %s numbers separated by commas).", name, value, expected )
+  }
 
-    if targetWidth == originalWidth && targetHeight == originalHeight {
-      message = fmt.Sprintf( "Converting %s [%s] %dx%d (no resize needed)",
-        filepath.Base( inputPath ),
-        format,
-        originalWidth,
-        originalHeight,
-      )
-      destinationImage = sourceImage
-      resized = false
-    } else {
-      resizeMode := "maintaining aspect ratio"
-      if maxWidth > 0 && maxHeight > 0 {
-        resizeMode = fmt.Sprintf( "fit within %dx%d", maxWidth, maxHeight )
+  numbers := make( []float64, len( fields ) )
+  for index, field := range fields {
+    number, err := strconv.ParseFloat( field, 64 )
+    if err != nil || math.IsNaN( number ) || math.IsInf( number, 0 ) {
+      return nil, fmt.Errorf( "The %s %s is not valid (%s is not a number).", name, value, field )
+    }
+    numbers[ index ] = number
+  }
+
+  return numbers, nil
+}
+
+// parseAffine builds the matrix of the affine command, either given directly as six
+// numbers or composed of scale, shear, rotation and translation in that order, all
+// about the image origin
+func parseAffine( matrixValue string, translateValue string, scaleValue string, shearValue string,
+  rotate float64 ) ( f64.Aff3, error ) {
+  if matrixValue != "" {
+    if translateValue != "" || scaleValue != "" || shearValue != "" || rotate != 0 {
+      return f64.Aff3{}, fmt.Errorf( "A matrix cannot be combined with translate, scale, shear, or rotate." )
+    }
+    numbers, err := parseNumbers( matrixValue, "matrix", 6, 6 )
+    if err != nil {
+      return f64.Aff3{}, err
+    }
+    return f64.Aff3{ numbers[ 0 ], numbers[ 1 ], numbers[ 2 ], numbers[ 3 ], numbers[ 4 ], numbers[ 5 ] }, nil
+  }
+
+  matrix := f64.Aff3{ 1, 0, 0, 0, 1, 0 }
+
+  if scaleValue != "" {
+    numbers, err := parseNumbers( scaleValue, "scale", 1, 2 )
+    if err != nil {
+      return f64.Aff3{}, err
+    }
+    // a single factor scales both axes
+    scaleX, scaleY := numbers[ 0 ], numbers[ len( numbers ) - 1 ]
+    matrix = multiplyAffine( f64.Aff3{ scaleX, 0, 0, 0, scaleY, 0 }, matrix )
+  }
+
+  if shearValue != "" {
+    numbers, err := parseNumbers( shearValue, "shear", 1, 2 )
+    if err != nil {
+      return f64.Aff3{}, err
+    }
+    shearY := 0.0
+    if len( numbers ) == 2 {
+      shearY = numbers[ 1 ]
+    }
+    if math.Abs( numbers[ 0 ] ) >= 90 || math.Abs( shearY ) >= 90 {
+      return f64.Aff3{}, fmt.Errorf( "The shear %s is not valid (angles must be between -90 and 90 degrees).", shearValue )
+    }
+    matrix = multiplyAffine( f64.Aff3{
+      1, math.Tan( numbers[ 0 ] * math.Pi / 180 ), 0,
+      math.Tan( shearY * math.Pi / 180 ), 1, 0,
+    }, matrix )
+  }
+
+  if rotate != 0 {
+    sin, cos := math.Sincos( normalizeAngle( rotate ) * math.Pi / 180 )
+    matrix = multiplyAffine( f64.Aff3{ cos, -sin, 0, sin, cos, 0 }, matrix )
+  }
+
+  if translateValue != "" {
+    numbers, err := parseNumbers( translateValue, "translation", 2, 2 )
+    if err != nil {
+      return f64.Aff3{}, err
+    }
+    matrix = multiplyAffine( f64.Aff3{ 1, 0, numbers[ 0 ], 0, 1, numbers[ 1 ] }, matrix )
+  }
+
+  return matrix, nil
+}
+
+// newBorderedImage copies the image onto a canvas one transparent pixel larger on every
+// side, keeping the source coordinates
+func newBorderedImage( img image.Image ) draw.Image {
+  bounds := img.Bounds()
+  var bordered draw.Image
+  if imageDepth( img ) == 16 {
+    bordered = image.NewNRGBA64( bounds.Inset( -1 ) )
+  } else {
+    bordered = image.NewNRGBA( bounds.Inset( -1 ) )
+  }
+
+  draw.Draw( bordered, bounds, img, bounds.Min, draw.Src )
+  return bordered
+}
+
+// homography maps the unit square onto a quadrilateral:
+// x = ( A u + B v + C ) / ( G u + H v + 1 ), y = ( D u + E v + F ) / ( G u + H v + 1 )
+type homography struct {
+  A, B, C               float64
+  D, E, F               float64
+  G, H                  float64
+}
+
+// squareToQuad returns the projective mapping that takes the corners ( 0,0 ), ( 1,0 ),
+// ( 1,1 ) and ( 0,1 ) of the unit square to the four corners in the same order
+// ( Heckbert's closed form ); it fails when three of the corners are collinear
+func squareToQuad( corners [ 4 ][ 2 ]float64 ) ( homography, bool ) {
+  x0, y0 := corners[ 0 ][ 0 ], corners[ 0 ][ 1 ]
+  x1, y1 := corners[ 1 ][ 0 ], corners[ 1 ][ 1 ]
+  x2, y2 := corners[ 2 ][ 0 ], corners[ 2 ][ 1 ]
+  x3, y3 := corners[ 3 ][ 0 ], corners[ 3 ][ 1 ]
+
+  sumX := x0 - x1 + x2 - x3
+  sumY := y0 - y1 + y2 - y3
+  if sumX == 0 && sumY == 0 {
+    // a parallelogram only needs an affine mapping
+    return homography{ A: x1 - x0, B: x2 - x1, C: x0, D: y1 - y0, E: y2 - y1, F: y0 }, true
+  }
+
+  dx1, dx2 := x1 - x2, x3 - x2
+  dy1, dy2 := y1 - y2, y3 - y2
+  determinant := dx1 * dy2 - dx2 * dy1
+  if determinant == 0 {
+    return homography{}, false
+  }
+
+  g := ( sumX * dy2 - dx2 * sumY ) / determinant
+  h := ( dx1 * sumY - sumX * dy1 ) / determinant
+  return homography{
+    A: x1 - x0 + g * x1, B: x3 - x0 + h * x3, C: x0,
+    D: y1 - y0 + g * y1, E: y3 - y0 + h * y3, F: y0,
+    G: g, H: h,
+  }, true
+}
+
+func ( mapping homography ) apply( u float64, v float64 ) ( float64, float64 ) {
+  w := mapping.G * u + mapping.H * v + 1
+  return ( mapping.A * u + mapping.B * v + mapping.C ) / w, ( mapping.D * u + mapping.E * v + mapping.F ) / w
+}
+
+// isConvexQuad reports whether the corners, taken in order, outline a convex
+// quadrilateral without crossing edges
+func isConvexQuad( corners [ 4 ][ 2 ]float64 ) bool {
+  sign := 0.0
+  for index := range corners {
+    a, b, c := corners[ index ], corners[ ( index + 1 ) % 4 ], corners[ ( index + 2 ) % 4 ]
+    cross := ( b[ 0 ] - a[ 0 ] ) * ( c[ 1 ] - b[ 1 ] ) - ( b[ 1 ] - a[ 1 ] ) * ( c[ 0 ] - b[ 0 ] )
+    if cross == 0 || ( sign != 0 && ( cross > 0 ) != ( sign > 0 ) ) {
+      return false
+    }
+    sign = cross
+  }
+  return true
+}
+
+// quadSize infers the output size of a rectified quadrilateral from its longest
+// opposite edges
+func quadSize( corners [ 4 ][ 2 ]float64 ) ( int, int ) {
+  length := func( a [ 2 ]float64, b [ 2 ]float64 ) float64 {
+    return math.Hypot( b[ 0 ] - a[ 0 ], b[ 1 ] - a[ 1 ] )
+  }
+
+  width := math.Max( length( corners[ 0 ], corners[ 1 ] ), length( corners[ 3 ], corners[ 2 ] ) )
+  height := math.Max( length( corners[ 0 ], corners[ 3 ] ), length( corners[ 1 ], corners[ 2 ] ) )
+  return max( int( math.Round( width ) ), 1 ), max( int( math.Round( height ) ), 1 )
+}
+
+func catmullRomWeight( t float64 ) float64 {
+  t = math.Abs( t )
+  if t < 1 {
+    return ( 1.5 * t - 2.5 ) * t * t + 1
+  }
+  if t < 2 {
+    return ( ( -0.5 * t + 2.5 ) * t - 4 ) * t + 2
+  }
+  return 0
+}
+
+// samplePremultiplied interpolates the premultiplied color at a point whose whole
+// coordinates are pixel centers; samples outside the source are transparent
+func samplePremultiplied( source *image.RGBA64, x float64, y float64, filterName string ) [ 4 ]float64 {
+  bounds := source.Bounds()
+  var sum [ 4 ]float64
+  add := func( column int, row int, weight float64 ) {
+    if weight == 0 || !image.Pt( column, row ).In( bounds ) {
+      return
+    }
+    pixel := source.Pix[ source.PixOffset( column, row ): ]
+    for channel := 0; channel < 4; channel++ {
+      sum[ channel ] += weight * float64( uint16( pixel[ channel * 2 ] ) << 8 | uint16( pixel[ channel * 2 + 1 ] ) )
+    }
+  }
+
+  switch filterName {
+  case "nearest":
+    add( int( math.Floor( x + 0.5 ) ), int( math.Floor( y + 0.5 ) ), 1 )
+    return sum
+  case "catmull-rom":
+    left, top := math.Floor( x ), math.Floor( y )
+    for row := -1; row <= 2; row++ {
+      rowWeight := catmullRomWeight( y - top - float64( row ) )
+      for column := -1; column <= 2; column++ {
+        add( int( left ) + column, int( top ) + row, rowWeight * catmullRomWeight( x - left - float64( column ) ) )
       }
-      if noEnlarge {
-        resizeMode += ", no enlargement"
+    }
+
+    // the negative lobes can overshoot; keep the result a valid premultiplied color
+    sum[ 3 ] = math.Min( math.Max( sum[ 3 ], 0 ), 0xffff )
+    for channel := 0; channel < 3; channel++ {
+      sum[ channel ] = math.Min( math.Max( sum[ channel ], 0 ), sum[ 3 ] )
+    }
+    return sum
+  }
+
+  left, top := math.Floor( x ), math.Floor( y )
+  fractionX, fractionY := x - left, y - top
+  add( int( left ), int( top ), ( 1 - fractionX ) * ( 1 - fractionY ) )
+  add( int( left ) + 1, int( top ), fractionX * ( 1 - fractionY ) )
+  add( int( left ), int( top ) + 1, ( 1 - fractionX ) * fractionY )
+  add( int( left ) + 1, int( top ) + 1, fractionX * fractionY )
+  return sum
+}
+
+// warpPerspective maps the quadrilateral with the given corners ( top left, top right,
+// bottom right and bottom left, relative to the image origin ) onto a width by height
+// rectangle. areas outside the source are filled with the background
+func warpPerspective( img image.Image, corners [ 4 ][ 2 ]float64, width int, height int,
+  filterName string, background color.Color, threads int ) image.Image {
+  bounds := img.Bounds()
+  for index := range corners {
+    corners[ index ][ 0 ] += float64( bounds.Min.X )
+    corners[ index ][ 1 ] += float64( bounds.Min.Y )
+  }
+  mapping, _ := squareToQuad( corners )
+
+  source, ok := img.( *image.RGBA64 )
+  if !ok {
+    source = image.NewRGBA64( bounds )
+    draw.Draw( source, bounds, img, bounds.Min, draw.Src )
+  }
+
+  warped := newBackgroundCanvas( img, image.Rect( 0, 0, width, height ), background )
+  backgroundR, backgroundG, backgroundB, backgroundA := background.RGBA()
+
+  parallelRows( height, threads, func( start int, end int ) {
+    for y := start; y < end; y++ {
+      v := ( float64( y ) + 0.5 ) / float64( height )
+      for x := 0; x < width; x++ {
+        sourceX, sourceY := mapping.apply( ( float64( x ) + 0.5 ) / float64( width ), v )
+        sample := samplePremultiplied( source, sourceX - 0.5, sourceY - 0.5, filterName )
+
+        // blend the sample over the background
+        remaining := 1 - sample[ 3 ] / 0xffff
+        warped.Set( x, y, color.RGBA64{
+          uint16( sample[ 0 ] + float64( backgroundR ) * remaining + 0.5 ),
+          uint16( sample[ 1 ] + float64( backgroundG ) * remaining + 0.5 ),
+          uint16( sample[ 2 ] + float64( backgroundB ) * remaining + 0.5 ),
+          uint16( sample[ 3 ] + float64( backgroundA ) * remaining + 0.5 ),
+        } )
       }
+    }
+  } )
 
-      message = fmt.Sprintf( "Resizing %s [%s] from %dx%d to %dx%d (%s)",
-        filepath.Base( inputPath ),
-        format,
-        originalWidth,
-        originalHeight,
-        targetWidth,
-        targetHeight,
-        resizeMode,
-      )
+  return warped
+}
 
-      resizedImage := image.NewRGBA( image.Rect( 0, 0, targetWidth, targetHeight ) )
+// the box kernel averages every source pixel that falls under a destination pixel
+// when shrinking ( area averaging ), and behaves like nearest neighbour when enlarging
+var boxKernel = &draw.Kernel{
+  Support: 0.5,
+  At: func( t float64 ) float64 {
+    return 1
+  },
+}
 
-      draw.BiLinear.Scale(
-        resizedImage,
-        resizedImage.Bounds(),
-        sourceImage,
-        sourceImage.Bounds(),
-        draw.Over,
-        nil,
-      )
+var lanczos3Kernel = &draw.Kernel{
+  Support: 3,
+  At: func( t float64 ) float64 {
+    if t == 0 {
+      return 1
+    }
+    // the sinc terms vanish at whole pixel offsets; returning an exact zero keeps
+    // neighbouring pixels out of the result when an axis is not being scaled
+    if t >= 3 || t == math.Trunc( t ) {
+      return 0
+    }
+    x := math.Pi * t
+    return 3 * math.Sin( x ) * math.Sin( x / 3 ) / ( x * x )
+  },
+}
+
+func parseFilter( name string ) ( draw.Interpolator, string, error ) {
+  switch strings.ToLower( strings.TrimSpace( name ) ) {
+  case "nearest", "nearest-neighbor":
+    return draw.NearestNeighbor, "nearest", nil
+  case "", "bilinear":
+    return draw.BiLinear, "bilinear", nil
+  case "catmull-rom", "catmullrom", "bicubic":
+    return draw.CatmullRom, "catmull-rom", nil
+  case "lanczos3", "lanczos":
+    return lanczos3Kernel, "lanczos3", nil
+  case "box", "area":
+    return boxKernel, "box", nil
+  }
+
+  return nil, "", fmt.Errorf(
+    "The filter %s is not supported (expected nearest, bilinear, catmull-rom, lanczos3, or box).", name )
+}
+
+type resizeOptions struct {
+  Filter                draw.Interpolator
+  Linear                bool
+  Threads               int
+}
+
+func resizeImage( img image.Image, sourceRect image.Rectangle, width int, height int,
+  options resizeOptions ) image.Image {
+  if options.Linear {
+    // resample linear light values so that averaging bright and dark detail keeps
+    // its true brightness; sixteen bits keep the dark tones from banding
+    linear := toLinearLight( img, sourceRect, options.Threads )
+    resized := image.NewRGBA64( image.Rect( 0, 0, width, height ) )
+    parallelScale( resized, linear, sourceRect, options.Filter, options.Threads )
+    return fromLinearLight( resized, newCanvas( img, resized.Bounds(), false ), options.Threads )
+  }
+
+  // only nearest neighbour sampling keeps every pixel on the source palette
+  resized := newCanvas( img, image.Rect( 0, 0, width, height ), options.Filter == draw.NearestNeighbor )
+  parallelScale( resized, img, sourceRect, options.Filter, options.Threads )
+
+  return resized
+}
+
+// parallelRows splits the rows [0, count) into bands and runs them on a pool of up to
+// threads goroutines, returning once every band is done
+func parallelRows( count int, threads int, work func( start int, end int ) ) {
+  threads = min( threads, count )
+  if threads <= 1 {
+    work( 0, count )
+    return
+  }
+
+  // a few bands per worker keeps them all busy when some bands finish early
+  bands := min( threads * 4, count )
+  jobs := make( chan int, bands )
+  for band := 0; band < bands; band++ {
+    jobs <- band
+  }
+  close( jobs )
+
+  var group sync.WaitGroup
+  for worker := 0; worker < threads; worker++ {
+    group.Add( 1 )
+    go func() {
+      defer group.Done()
+      for band := range jobs {
+        work( band * count / bands, ( band + 1 ) * count / bands )
+      }
+    }()
+  }
+  group.Wait()
+}
+
+// parallelScale scales the source rectangle onto the whole destination like the filter's
+// Scale with draw.Src, producing identical pixels while spreading the work over threads
+func parallelScale( destination draw.Image, source image.Image, sourceRect image.Rectangle,
+  filter draw.Interpolator, threads int ) {
+  bounds := destination.Bounds()
+  subImager, canSplit := destination.( interface{ SubImage( image.Rectangle ) image.Image } )
+  kernel, isKernel := filter.( *draw.Kernel )
+
+  switch {
+  case threads <= 1 || !canSplit:
+    filter.Scale( destination, bounds, source, sourceRect, draw.Src, nil )
+  case isKernel:
+    newKernelScaler( kernel, bounds.Dx(), bounds.Dy(), sourceRect.Dx(), sourceRect.Dy() ).
+      scale( destination, source, sourceRect, threads )
+  default:
+    // nearest neighbour and approximate bilinear sample each destination pixel on its
+    // own, so every band can be scaled against the full rectangle
+    parallelRows( bounds.Dy(), threads, func( start int, end int ) {
+      band := image.Rect( bounds.Min.X, bounds.Min.Y + start, bounds.Max.X, bounds.Min.Y + end )
+      filter.Scale( subImager.SubImage( band ).( draw.Image ), bounds, source, sourceRect, draw.Src, nil )
+    } )
+  }
+}
+
+// kernelScaler reproduces the separable resampling of draw.Kernel: the source columns
+// are distributed over a temporary image, whose rows are then distributed over the
+// destination. the arithmetic follows golang.org/x/image/draw step for step ( including
+// the explicit float64 conversions that prevent fused multiply-adds ) so the output is
+// the same, but both passes are split into bands of independent rows
+type kernelScaler struct {
+  horizontal            kernelWeights
+  vertical              kernelWeights
+}
+
+// kernelWeights lists, for each destination column or row, the weighted source columns
+// or rows that contribute to it
+type kernelWeights struct {
+  Taps                  [][]kernelTap
+  InverseTotal          []float64
+}
+
+type kernelTap struct {
+  Coordinate            int
+  Weight                float64
+}
+
+func newKernelScaler( kernel *draw.Kernel, destinationWidth int, destinationHeight int,
+  sourceWidth int, sourceHeight int ) *kernelScaler {
+  return &kernelScaler{
+    horizontal: newKernelWeights( kernel, destinationWidth, sourceWidth ),
+    vertical:   newKernelWeights( kernel, destinationHeight, sourceHeight ),
+  }
+}
+
+func newKernelWeights( kernel *draw.Kernel, destinationLength int, sourceLength int ) kernelWeights {
+  scale := float64( sourceLength ) / float64( destinationLength )
+  halfWidth, argumentScale := kernel.Support, 1.0
+  // when shrinking, the kernel is stretched so that every source pixel is visited
+  if scale > 1 {
+    halfWidth *= scale
+    argumentScale = 1 / scale
+  }
+
+  weights := kernelWeights{
+    Taps:         make( [][]kernelTap, destinationLength ),
+    InverseTotal: make( []float64, destinationLength ),
+  }
+
+  for position := 0; position < destinationLength; position++ {
+    center := float64( ( float64( position ) + 0.5 ) * scale ) - 0.5
+    first := max( 0, int( math.Floor( center - halfWidth ) ) )
+    last := int( math.Ceil( center + halfWidth ) )
+    if last > sourceLength {
+      last = max( sourceLength, first )
+    }
+
+    total := 0.0
+    for coordinate := first; coordinate < last; coordinate++ {
+      t := math.Abs( ( center - float64( coordinate ) ) * argumentScale )
+      if t >= kernel.Support {
+        continue
+      }
+
+      weight := kernel.At( t )
+      if weight == 0 {
+        continue
+      }
+
+      total += weight
+      weights.Taps[ position ] = append( weights.Taps[ position ], kernelTap{ coordinate, weight } )
+    }
+    weights.InverseTotal[ position ] = 1 / total
+  }
+
+  return weights
+}
+
+func ( scaler *kernelScaler ) scale( destination draw.Image, source image.Image, sourceRect image.Rectangle, threads int ) {
+  bounds := destination.Bounds()
+  width := len( scaler.horizontal.Taps )
+
+  // premultiplied colors in the range 0 to 1, one row per source row
+  temporary := make( [][ 4 ]float64, width * sourceRect.Dy() )
+
+  parallelRows( sourceRect.Dy(), threads, func( start int, end int ) {
+    pixels := make( [][ 4 ]uint32, sourceRect.Dx() )
+    for y := start; y < end; y++ {
+      row := temporary[ y * width : ( y + 1 ) * width ]
+      scaler.scaleRow( row, pixels, source, sourceRect.Min.Y + y, sourceRect.Min.X )
+    }
+  } )
+
+  rgba, isRGBA := destination.( *image.RGBA )
+  direct, isDirect := destination.( draw.RGBA64Image )
+  parallelRows( bounds.Dy(), threads, func( start int, end int ) {
+    for y := start; y < end; y++ {
+      taps := scaler.vertical.Taps[ y ]
+      inverseTotal := scaler.vertical.InverseTotal[ y ]
+
+      for x := 0; x < width; x++ {
+        var r, g, b, a float64
+        for _, tap := range taps {
+          pixel := &temporary[ tap.Coordinate * width + x ]
+          r += float64( pixel[ 0 ] * tap.Weight )
+          g += float64( pixel[ 1 ] * tap.Weight )
+          b += float64( pixel[ 2 ] * tap.Weight )
+          a += float64( pixel[ 3 ] * tap.Weight )
+        }
+
+        r, g, b = min( r, a ), min( g, a ), min( b, a )
+        value := color.RGBA64{
+          unitToUint16( r * inverseTotal ),
+          unitToUint16( g * inverseTotal ),
+          unitToUint16( b * inverseTotal ),
+          unitToUint16( a * inverseTotal ),
+        }
+
+        switch {
+        case isRGBA:
+          pixel := rgba.Pix[ rgba.PixOffset( bounds.Min.X + x, bounds.Min.Y + y ): ]
+          pixel[ 0 ], pixel[ 1 ], pixel[ 2 ], pixel[ 3 ] = uint8( value.R >> 8 ), uint8( value.G >> 8 ), uint8( value.B >> 8 ), uint8( value.A >> 8 )
+        case isDirect:
+          direct.SetRGBA64( bounds.Min.X + x, bounds.Min.Y + y, value )
+        default:
+          destination.Set( bounds.Min.X + x, bounds.Min.Y + y, value )
+        }
+      }
+    }
+  } )
+}
+
+// scaleRow distributes one source row over a row of the temporary image, reading the
+// source pixels into the pixels buffer first so that each is decoded once
+func ( scaler *kernelScaler ) scaleRow( row [][ 4 ]float64, pixels [][ 4 ]uint32, source image.Image, y int, left int ) {
+  readPremultipliedRow( pixels, source, y, left )
+  _, isGray := source.( *image.Gray )
+
+  for x, taps := range scaler.horizontal.Taps {
+    inverseTotal := scaler.horizontal.InverseTotal[ x ] / 0xffff
+
+    var r, g, b, a float64
+    for _, tap := range taps {
+      pixel := &pixels[ tap.Coordinate ]
+      r += float64( float64( pixel[ 0 ] ) * tap.Weight )
+      g += float64( float64( pixel[ 1 ] ) * tap.Weight )
+      b += float64( float64( pixel[ 2 ] ) * tap.Weight )
+      a += float64( float64( pixel[ 3 ] ) * tap.Weight )
+    }
+
+    if isGray {
+      // gray pixels are opaque, and x/image gives them an alpha of exactly one
+      row[ x ] = [ 4 ]float64{ r * inverseTotal, r * inverseTotal, r * inverseTotal, 1 }
+    } else {
+      row[ x ] = [ 4 ]float64{ r * inverseTotal, g * inverseTotal, b * inverseTotal, a * inverseTotal }
+    }
+  }
+}
+
+// readPremultipliedRow reads len( pixels ) premultiplied 16-bit pixels of row y, starting at left
+func readPremultipliedRow( pixels [][ 4 ]uint32, source image.Image, y int, left int ) {
+  switch typed := source.( type ) {
+  case *image.RGBA:
+    row := typed.Pix[ typed.PixOffset( left, y ): ]
+    for x := range pixels {
+      pixel := row[ x * 4 : x * 4 + 4 : x * 4 + 4 ]
+      pixels[ x ] = [ 4 ]uint32{ uint32( pixel[ 0 ] ) * 0x101, uint32( pixel[ 1 ] ) * 0x101, uint32( pixel[ 2 ] ) * 0x101, uint32( pixel[ 3 ] ) * 0x101 }
+    }
+  case *image.NRGBA:
+    row := typed.Pix[ typed.PixOffset( left, y ): ]
+    for x := range pixels {
+      // premultiply exactly as color.NRGBA does
+      pixel := row[ x * 4 : x * 4 + 4 : x * 4 + 4 ]
+      alpha := uint32( pixel[ 3 ] ) * 0x101
+      pixels[ x ] = [ 4 ]uint32{ uint32( pixel[ 0 ] ) * alpha / 0xff, uint32( pixel[ 1 ] ) * alpha / 0xff, uint32( pixel[ 2 ] ) * alpha / 0xff, alpha }
+    }
+  case *image.Gray:
+    row := typed.Pix[ typed.PixOffset( left, y ): ]
+    for x := range pixels {
+      value := uint32( row[ x ] ) * 0x101
+      pixels[ x ] = [ 4 ]uint32{ value, value, value, 0xffff }
+    }
+  case image.RGBA64Image:
+    for x := range pixels {
+      pixel := typed.RGBA64At( left + x, y )
+      pixels[ x ] = [ 4 ]uint32{ uint32( pixel.R ), uint32( pixel.G ), uint32( pixel.B ), uint32( pixel.A ) }
+    }
+  default:
+    for x := range pixels {
+      r, g, b, a := source.At( left + x, y ).RGBA()
+      pixels[ x ] = [ 4 ]uint32{ r, g, b, a }
+    }
+  }
+}
+
+// unitToUint16 converts the range 0 to 1 into 0 to 0xffff, rounding like x/image
+func unitToUint16( value float64 ) uint16 {
+  scaled := int32( float64( 0xffff * value ) + 0.5 )
+  if scaled > 0xffff {
+    return 0xffff
+  }
+  if scaled > 0 {
+    return uint16( scaled )
+  }
+  return 0
+}
+
+// newCanvas creates an empty image with the color model and bit depth of the model
+// image, so that grayscale and 16-bit sources are not widened or truncated. paletted
+// images keep their palette only when every output pixel is copied from the source
+// ( exact ); sources without a writable equivalent ( such as YCbCr ) get 8-bit RGBA
+func newCanvas( model image.Image, rect image.Rectangle, exact bool ) draw.Image {
+  switch source := model.( type ) {
+  case *image.Gray:
+    return image.NewGray( rect )
+  case *image.Gray16:
+    return image.NewGray16( rect )
+  case *image.NRGBA:
+    return image.NewNRGBA( rect )
+  case *image.NRGBA64:
+    return image.NewNRGBA64( rect )
+  case *image.RGBA64:
+    return image.NewRGBA64( rect )
+  case *image.Paletted:
+    if exact {
+      return image.NewPaletted( rect, source.Palette )
+    }
+    return image.NewNRGBA( rect )
+  }
+
+  return image.NewRGBA( rect )
+}
+
+// canvasAccepts reports whether the canvas can store the color without changing it,
+// for example a transparent background cannot be stored in a grayscale image
+func canvasAccepts( canvas image.Image, value color.Color ) bool {
+  r, g, b, a := value.RGBA()
+  cr, cg, cb, ca := canvas.ColorModel().Convert( value ).RGBA()
+  return r == cr && g == cg && b == cb && a == ca
+}
+
+// newBackgroundCanvas creates a canvas filled with the background for drawing the image
+// onto, widening the image's color model when it cannot hold the background
+func newBackgroundCanvas( img image.Image, rect image.Rectangle, background color.Color ) draw.Image {
+  // blending over the background can produce colors outside a palette
+  canvas := newCanvas( img, rect, false )
+  if !canvasAccepts( canvas, background ) {
+    // widen to a model that can hold the background, keeping 16-bit precision
+    if imageDepth( img ) == 16 {
+      canvas = image.NewNRGBA64( rect )
+    } else {
+      canvas = image.NewNRGBA( rect )
+    }
+  }
+
+  draw.Draw( canvas, rect, image.NewUniform( background ), image.Point{}, draw.Src )
+  return canvas
+}
+
+// convertDepth returns the image converted to 8 or 16 bits per channel, keeping
+// grayscale images grayscale; a depth of zero keeps the image as it is
+func convertDepth( img image.Image, depth int ) image.Image {
+  bounds := img.Bounds()
+  var converted draw.Image
+
+  switch img.( type ) {
+  case *image.Gray:
+    if depth == 16 {
+      converted = image.NewGray16( bounds )
+    }
+  case *image.Gray16:
+    if depth == 8 {
+      converted = image.NewGray( bounds )
+    }
+  case *image.NRGBA, *image.Paletted:
+    if depth == 16 {
+      converted = image.NewNRGBA64( bounds )
+    }
+  case *image.NRGBA64:
+    if depth == 8 {
+      converted = image.NewNRGBA( bounds )
+    }
+  case *image.RGBA64:
+    if depth == 8 {
+      converted = image.NewRGBA( bounds )
+    }
+  default:
+    if depth == 16 {
+      converted = image.NewRGBA64( bounds )
+    }
+  }
+
+  if converted == nil {
+    return img
+  }
+
+  draw.Draw( converted, bounds, img, bounds.Min, draw.Src )
+  return converted
+}
+
+func imageDepth( img image.Image ) int {
+  switch img.( type ) {
+  case *image.Gray16, *image.NRGBA64, *image.RGBA64, *image.Alpha16:
+    return 16
+  }
+  return 8
+}
+
+func colorModelName( img image.Image ) string {
+  return strings.TrimPrefix( fmt.Sprintf( "%T", img ), "*image." )
+}
+
+var gammaTablesOnce sync.Once
+var srgbToLinearTable []uint16
+var linearToSrgbTable []uint16
+
+func gammaTables() ( []uint16, []uint16 ) {
+  gammaTablesOnce.Do( func() {
+    srgbToLinearTable = make( []uint16, 0x10000 )
+    linearToSrgbTable = make( []uint16, 0x10000 )
+
+    for index := range srgbToLinearTable {
+      value := float64( index ) / 0xffff
+
+      linear := value / 12.92
+      if value > 0.04045 {
+        linear = math.Pow( ( value + 0.055 ) / 1.055, 2.4 )
+      }
+      srgbToLinearTable[ index ] = uint16( linear * 0xffff + 0.5 )
+
+      encoded := value * 12.92
+      if value > 0.0031308 {
+        encoded = 1.055 * math.Pow( value, 1 / 2.4 ) - 0.055
+      }
+      linearToSrgbTable[ index ] = uint16( encoded * 0xffff + 0.5 )
+    }
+  } )
+
+  return srgbToLinearTable, linearToSrgbTable
+}
+
+// convertPremultiplied maps each color channel through the table; the channels are
+// un-premultiplied first so that the curve is applied to the real color, not to a
+// value already scaled by alpha
+func convertPremultiplied( r uint32, g uint32, b uint32, a uint32, table []uint16 ) color.RGBA64 {
+  if a == 0 {
+    return color.RGBA64{}
+  }
+
+  convert := func( channel uint32 ) uint16 {
+    straight := min( channel * 0xffff / a, 0xffff )
+    return uint16( uint32( table[ straight ] ) * a / 0xffff )
+  }
+
+  return color.RGBA64{ convert( r ), convert( g ), convert( b ), uint16( a ) }
+}
+
+func toLinearLight( img image.Image, rect image.Rectangle, threads int ) *image.RGBA64 {
+  toLinear, _ := gammaTables()
+  linear := image.NewRGBA64( rect )
+  direct, isDirect := img.( image.RGBA64Image )
+
+  parallelRows( rect.Dy(), threads, func( start int, end int ) {
+    for y := rect.Min.Y + start; y < rect.Min.Y + end; y++ {
+      for x := rect.Min.X; x < rect.Max.X; x++ {
+        var r, g, b, a uint32
+        if isDirect {
+          // avoids boxing every pixel in a color.Color interface
+          pixel := direct.RGBA64At( x, y )
+          r, g, b, a = uint32( pixel.R ), uint32( pixel.G ), uint32( pixel.B ), uint32( pixel.A )
+        } else {
+          r, g, b, a = img.At( x, y ).RGBA()
+        }
+        linear.SetRGBA64( x, y, convertPremultiplied( r, g, b, a, toLinear ) )
+      }
+    }
+  } )
+
+  return linear
+}
+
+// fromLinearLight converts the linear light image back to sRGB, storing the result in
+// the given canvas ( which must have the same bounds )
+func fromLinearLight( linear *image.RGBA64, canvas draw.Image, threads int ) image.Image {
+  _, toSrgb := gammaTables()
+  bounds := linear.Bounds()
+  rgba, isRGBA := canvas.( *image.RGBA )
+
+  parallelRows( bounds.Dy(), threads, func( start int, end int ) {
+    for y := bounds.Min.Y + start; y < bounds.Min.Y + end; y++ {
+      for x := bounds.Min.X; x < bounds.Max.X; x++ {
+        pixel := linear.RGBA64At( x, y )
+        converted := convertPremultiplied( uint32( pixel.R ), uint32( pixel.G ), uint32( pixel.B ), uint32( pixel.A ), toSrgb )
+
+        if !isRGBA {
+          canvas.Set( x, y, converted )
+          continue
+        }
+
+        // round rather than truncate to eight bits, the common case
+        offset := rgba.PixOffset( x, y )
+        rgba.Pix[ offset ] = uint8( ( uint32( converted.R ) * 0xff + 0x7fff ) / 0xffff )
+        rgba.Pix[ offset + 1 ] = uint8( ( uint32( converted.G ) * 0xff + 0x7fff ) / 0xffff )
+        rgba.Pix[ offset + 2 ] = uint8( ( uint32( converted.B ) * 0xff + 0x7fff ) / 0xffff )
+        rgba.Pix[ offset + 3 ] = uint8( ( uint32( converted.A ) * 0xff + 0x7fff ) / 0xffff )
+      }
+    }
+  } )
+
+  return canvas
+}
+
+// padImage places the image at the given offset on a canvas of the requested size
+// filled with the background color
+func padImage( img image.Image, width int, height int, offset image.Point, background color.Color ) image.Image {
+  canvas := newBackgroundCanvas( img, image.Rect( 0, 0, width, height ), background )
+
+  bounds := img.Bounds()
+  draw.Draw( canvas, bounds.Sub( bounds.Min ).Add( offset ), img, bounds.Min, draw.Over )
+
+  return canvas
+}
+
+func parseColor( value string ) ( color.NRGBA, error ) {
+  normalized := strings.ToLower( strings.ReplaceAll( strings.TrimSpace( value ), " ", "" ) )
+
+  switch normalized {
+  case "", "transparent", "none":
+    return color.NRGBA{}, nil
+  case "white":
+    return color.NRGBA{ 255, 255, 255, 255 }, nil
+  case "black":
+    return color.NRGBA{ 0, 0, 0, 255 }, nil
+  }
+
+  invalid := fmt.Errorf(
+    "The color %s is not valid (expected a hex value such as #ffffff, rgb(r,g,b), rgba(r,g,b,a), or transparent).",
+    value )
+
+  if strings.HasPrefix( normalized, "rgb(" ) || strings.HasPrefix( normalized, "rgba(" ) {
+    if !strings.HasSuffix( normalized, ")" ) {
+      return color.NRGBA{}, invalid
+    }
+
+    arguments := normalized[ strings.Index( normalized, "(" ) + 1 : len( normalized ) - 1 ]
+    components := strings.Split( arguments, "," )
+    if len( components ) != 3 && len( components ) != 4 {
+      return color.NRGBA{}, invalid
+    }
+
+    channels := [ 4 ]uint8{ 0, 0, 0, 255 }
+    for index, component := range components {
+      if index == 3 {
+        // alpha follows the css convention of a fraction between 0 and 1
+        alpha, err := strconv.ParseFloat( component, 64 )
+        if err != nil || alpha < 0 || alpha > 1 {
+          return color.NRGBA{}, invalid
+        }
+        channels[ 3 ] = uint8( alpha * 255 + 0.5 )
+        continue
+      }
+
+      channel, err := strconv.Atoi( component )
+      if err != nil || channel < 0 || channel > 255 {
+        return color.NRGBA{}, invalid
+      }
+      channels[ index ] = uint8( channel )
+    }
+
+    return color.NRGBA{ channels[ 0 ], channels[ 1 ], channels[ 2 ], channels[ 3 ] }, nil
+  }
+
+  hex := strings.TrimPrefix( normalized, "#" )
+
+  // expand the short forms ( #rgb and #rgba ) to their long equivalents
+  if len( hex ) == 3 || len( hex ) == 4 {
+    expanded := make( []byte, 0, len( hex ) * 2 )
+    for index := 0; index < len( hex ); index++ {
+      expanded = append( expanded, hex[ index ], hex[ index ] )
+    }
+    hex = string( expanded )
+  }
+
+  if len( hex ) == 6 {
+    hex += "ff"
+  }
+
+  if len( hex ) != 8 {
+    return color.NRGBA{}, invalid
+  }
+
+  packed, err := strconv.ParseUint( hex, 16, 32 )
+  if err != nil {
+    return color.NRGBA{}, invalid
+  }
+
+  return color.NRGBA{ uint8( packed >> 24 ), uint8( packed >> 16 ), uint8( packed >> 8 ), uint8( packed ) }, nil
+}
+
+type gravity struct {
+  Name                  string
+  X                     float64
+  Y                     float64
+  Smart                 bool
+}
+
+func parseGravity( name string ) ( gravity, error ) {
+  normalized := strings.ToLower( strings.TrimSpace( name ) )
+
+  switch normalized {
+  case "", "center", "centre":
+    return gravity{ "center", 0.5, 0.5, false }, nil
+  case "north":
+    return gravity{ normalized, 0.5, 0, false }, nil
+  case "south":
+    return gravity{ normalized, 0.5, 1, false }, nil
+  case "east":
+    return gravity{ normalized, 1, 0.5, false }, nil
+  case "west":
+    return gravity{ normalized, 0, 0.5, false }, nil
+  case "northeast":
+    return gravity{ normalized, 1, 0, false }, nil
+  case "northwest":
+    return gravity{ normalized, 0, 0, false }, nil
+  case "southeast":
+    return gravity{ normalized, 1, 1, false }, nil
+  case "southwest":
+    return gravity{ normalized, 0, 1, false }, nil
+  case "smart":
+    // smart crops fall back to the center when nothing in the image stands out
+    return gravity{ normalized, 0.5, 0.5, true }, nil
+  }
+
+  return gravity{}, fmt.Errorf(
+    "The gravity %s is not supported (expected center, north, south, east, west, northeast, " +
+    "northwest, southeast, southwest, or smart).", name )
+}
+
+// position a span of the given length inside the available length according to
+// the anchor fraction ( 0 is the start, 0.5 the middle, 1 the end )
+func anchorOffset( available int, length int, fraction float64 ) int {
+  return int( float64( available - length ) * fraction + 0.5 )
+}
+
+// parseLength reads a pixel count or a percentage of the total length ( such as 120,
+// -40 or 10% ), rounding percentages to the nearest pixel
+func parseLength( value string, total int, name string ) ( int, error ) {
+  normalized := strings.TrimSpace( value )
+  percent := strings.HasSuffix( normalized, "%" )
+  number, err := strconv.ParseFloat( strings.TrimSuffix( normalized, "%" ), 64 )
+  if err != nil || math.IsNaN( number ) || math.IsInf( number, 0 ) {
+    return 0, fmt.Errorf( "The %s %s is not valid ( expected pixels such as 120, or a percentage such as 10%% ).",
+      name, value )
+  }
+
+  if percent {
+    return int( math.Round( number * float64( total ) / 100 ) ), nil
+  }
+  if number != math.Trunc( number ) {
+    return 0, fmt.Errorf( "The %s %s is not a whole number of pixels.", name, value )
+  }
+  return int( number ), nil
+}
+
+// parseAspect reads an aspect ratio given as width:height ( such as 16:9 ) or as a
+// single number ( such as 1.5 )
+func parseAspect( value string ) ( float64, error ) {
+  invalid := fmt.Errorf( "The aspect ratio %s is not valid ( expected width:height such as 16:9, or a number such as 1.5 ).", value )
+
+  parts := strings.Split( strings.TrimSpace( value ), ":" )
+  if len( parts ) > 2 {
+    return 0, invalid
+  }
+
+  numbers := make( []float64, len( parts ) )
+  for index, part := range parts {
+    number, err := strconv.ParseFloat( strings.TrimSpace( part ), 64 )
+    if err != nil || math.IsNaN( number ) || math.IsInf( number, 0 ) || number <= 0 {
+      return 0, invalid
+    }
+    numbers[ index ] = number
+  }
+
+  if len( numbers ) == 2 {
+    return numbers[ 0 ] / numbers[ 1 ], nil
+  }
+  return numbers[ 0 ], nil
+}
+
+// aspectSize returns the largest size with the aspect ratio that fits in the image
+func aspectSize( width int, height int, ratio float64 ) ( int, int ) {
+  if float64( width ) / float64( height ) > ratio {
+    return min( max( int( math.Round( float64( height ) * ratio ) ), 1 ), width ), height
+  }
+  return width, min( max( int( math.Round( float64( width ) / ratio ) ), 1 ), height )
+}
+
+// resolveSpan turns an offset and a length along one axis of the image into the start
+// and length of a region. without an anchor the offset is the start, counted from the
+// far edge when negative; with an anchor the region is positioned by it and the offset
+// shifts it. a missing length covers the rest of the image, or all of it with an anchor
+func resolveSpan( offset string, length string, total int, anchor *float64,
+  offsetName string, lengthName string ) ( int, int, error ) {
+  shift := 0
+  if offset != "" {
+    parsed, err := parseLength( offset, total, offsetName )
+    if err != nil {
+      return 0, 0, err
+    }
+    shift = parsed
+  }
+
+  size := 0
+  if length != "" {
+    parsed, err := parseLength( length, total, lengthName )
+    if err != nil {
+      return 0, 0, err
+    }
+    if parsed <= 0 {
+      return 0, 0, fmt.Errorf( "The %s must be greater than zero, but got %s.", lengthName, length )
+    }
+    size = parsed
+  }
+
+  if anchor != nil {
+    if length == "" {
+      size = total
+    }
+    return anchorOffset( total, size, *anchor ) + shift, size, nil
+  }
+
+  start := shift
+  if strings.HasPrefix( strings.TrimSpace( offset ), "-" ) {
+    start = total + shift
+  }
+  if length == "" {
+    size = total - start
+  }
+  return start, size, nil
+}
+
+func fitDimensions( originalWidth int, originalHeight int, maxWidth int, maxHeight int,
+  noEnlarge bool ) ( int, int ) {
+  targetWidth := maxWidth
+  targetHeight := maxHeight
+
+  if maxWidth == 0 && maxHeight > 0 {
+    aspectRatio := float64( originalWidth ) / float64( originalHeight )
+    targetWidth = int( float64( targetHeight ) * aspectRatio + 0.5 )
+  } else if maxHeight == 0 && maxWidth > 0 {
+    aspectRatio := float64( originalHeight ) / float64( originalWidth )
+    targetHeight = int( float64( targetWidth ) * aspectRatio + 0.5 )
+  } else {
+    originalAspect := float64( originalWidth ) / float64( originalHeight )
+    targetAspect := float64( maxWidth ) / float64( maxHeight )
+
+    if originalAspect > targetAspect {
+      targetWidth = maxWidth
+      targetHeight = int( float64( maxWidth ) / originalAspect + 0.5 )
+    } else {
+      targetHeight = maxHeight
+      targetWidth = int( float64( maxHeight ) * originalAspect + 0.5 )
+    }
+  }
+
+  if noEnlarge {
+    if targetWidth > originalWidth || targetHeight > originalHeight {
+      targetWidth = originalWidth
+      targetHeight = originalHeight
+    }
+  }
+
+  return targetWidth, targetHeight
+}
+
+func stretchDimensions( originalWidth int, originalHeight int, width int, height int,
+  noEnlarge bool ) ( int, int ) {
+  // a missing dimension keeps the source size so a single axis can be stretched
+  if width == 0 {
+    width = originalWidth
+  }
+  if height == 0 {
+    height = originalHeight
+  }
+
+  if noEnlarge {
+    width = min( width, originalWidth )
+    height = min( height, originalHeight )
+  }
+
+  return width, height
+}
+
+func scaleDimensions( originalWidth int, originalHeight int, scale float64, noEnlarge bool ) ( int, int ) {
+  if noEnlarge && scale > 1 {
+    scale = 1
+  }
+
+  width := max( int( float64( originalWidth ) * scale + 0.5 ), 1 )
+  height := max( int( float64( originalHeight ) * scale + 0.5 ), 1 )
+
+  return width, height
+}
+
+type sizeLimits struct {
+  MaxPixels             int
+  MaxLongEdge           int
+  MaxShortEdge          int
+}
+
+func ( limits sizeLimits ) active() bool {
+  return limits.MaxPixels > 0 || limits.MaxLongEdge > 0 || limits.MaxShortEdge > 0
+}
+
+func ( limits sizeLimits ) String() string {
+  var parts []string
+  if limits.MaxPixels > 0 {
+    parts = append( parts, fmt.Sprintf( "at most %d pixels", limits.MaxPixels ) )
+  }
+  if limits.MaxLongEdge > 0 {
+    parts = append( parts, fmt.Sprintf( "long edge at most %d", limits.MaxLongEdge ) )
+  }
+  if limits.MaxShortEdge > 0 {
+    parts = append( parts, fmt.Sprintf( "short edge at most %d", limits.MaxShortEdge ) )
+  }
+  return strings.Join( parts, ", " )
+}
+
+// constrain finds the largest size with the same aspect ratio that satisfies every
+// limit; sizes already within the limits are returned unchanged
+func ( limits sizeLimits ) constrain( width int, height int ) ( int, int ) {
+  scale := 1.0
+  longEdge := float64( max( width, height ) )
+  shortEdge := float64( min( width, height ) )
+
+  if limits.MaxPixels > 0 && width * height > limits.MaxPixels {
+    scale = math.Min( scale, math.Sqrt( float64( limits.MaxPixels ) / ( float64( width ) * float64( height ) ) ) )
+  }
+  if limits.MaxLongEdge > 0 && longEdge > float64( limits.MaxLongEdge ) {
+    scale = math.Min( scale, float64( limits.MaxLongEdge ) / longEdge )
+  }
+  if limits.MaxShortEdge > 0 && shortEdge > float64( limits.MaxShortEdge ) {
+    scale = math.Min( scale, float64( limits.MaxShortEdge ) / shortEdge )
+  }
+
+  if scale >= 1 {
+    return width, height
+  }
+
+  fits := func( candidateWidth int, candidateHeight int ) bool {
+    longest := max( candidateWidth, candidateHeight )
+    shortest := min( candidateWidth, candidateHeight )
+    return ( limits.MaxPixels <= 0 || candidateWidth * candidateHeight <= limits.MaxPixels ) &&
+      ( limits.MaxLongEdge <= 0 || longest <= limits.MaxLongEdge ) &&
+      ( limits.MaxShortEdge <= 0 || shortest <= limits.MaxShortEdge )
+  }
+
+  // rounding keeps the aspect ratio closest, but may overshoot a limit by a pixel;
+  // rounding down never does ( a tiny epsilon absorbs floating point error )
+  roundedWidth := max( int( float64( width ) * scale + 0.5 ), 1 )
+  roundedHeight := max( int( float64( height ) * scale + 0.5 ), 1 )
+  if fits( roundedWidth, roundedHeight ) {
+    return roundedWidth, roundedHeight
+  }
+
+  flooredWidth := max( int( math.Floor( float64( width ) * scale + 1e-9 ) ), 1 )
+  flooredHeight := max( int( math.Floor( float64( height ) * scale + 1e-9 ) ), 1 )
+  for !fits( flooredWidth, flooredHeight ) && ( flooredWidth > 1 || flooredHeight > 1 ) {
+    flooredWidth = max( flooredWidth - 1, 1 )
+    flooredHeight = max( int( float64( flooredWidth ) * float64( height ) / float64( width ) ), 1 )
+  }
+
+  return flooredWidth, flooredHeight
+}
+
+func parsePixelCount( value string ) ( int, error ) {
+  normalized := strings.ToLower( strings.ReplaceAll( strings.TrimSpace( value ), " ", "" ) )
+  if normalized == "" {
+    return 0, nil
+  }
+
+  multiplier := 1.0
+  if strings.HasSuffix( normalized, "mp" ) {
+    normalized = strings.TrimSuffix( normalized, "mp" )
+    multiplier = 1000000
+  }
+
+  count, err := strconv.ParseFloat( normalized, 64 )
+  if err != nil || math.IsNaN( count ) || math.IsInf( count, 0 ) {
+    return 0, fmt.Errorf( "The pixel count %s is not valid (expected a number such as 1150000 or 1.15mp).", value )
+  }
+
+  pixels := int( math.Round( count * multiplier ) )
+  if pixels <= 0 {
+    return 0, fmt.Errorf( "The pixel count must be greater than zero, but got %s.", value )
+  }
+
+  return pixels, nil
+}
+
+func parseScale( value string ) ( float64, error ) {
+  normalized := strings.ToLower( strings.TrimSpace( value ) )
+  if normalized == "" {
+    return 0, nil
+  }
+
+  divisor := 1.0
+  if strings.HasSuffix( normalized, "%" ) {
+    normalized = strings.TrimSuffix( normalized, "%" )
+    divisor = 100
+  } else {
+    normalized = strings.TrimSuffix( normalized, "x" )
+  }
+
+  factor, err := strconv.ParseFloat( normalized, 64 )
+  if err != nil || math.IsNaN( factor ) || math.IsInf( factor, 0 ) {
+    return 0, fmt.Errorf( "The scale %s is not valid (expected a factor such as 0.5 or 2x, or a percentage such as 50%%).",
+      value )
+  }
+
+  factor /= divisor
+  if factor <= 0 {
+    return 0, fmt.Errorf( "The scale must be greater than zero, but got %s.", value )
+  }
+
+  return factor, nil
+}
+
+// coverRegion finds the source rectangle that, scaled to width x height, fills the
+// whole box; the overflow along one axis is cropped according to the gravity
+func coverRegion( bounds image.Rectangle, width int, height int, anchor gravity,
+  noEnlarge bool ) ( image.Rectangle, int, int ) {
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
+
+  scale := math.Max(
+    float64( width ) / float64( originalWidth ),
+    float64( height ) / float64( originalHeight ),
+  )
+
+  cropWidth := min( max( int( float64( width ) / scale + 0.5 ), 1 ), originalWidth )
+  cropHeight := min( max( int( float64( height ) / scale + 0.5 ), 1 ), originalHeight )
+
+  // without enlargement the crop is kept at the source resolution, so the output
+  // has the requested aspect ratio but may be smaller than the box
+  targetWidth := width
+  targetHeight := height
+  if noEnlarge && scale > 1 {
+    targetWidth = cropWidth
+    targetHeight = cropHeight
+  }
+
+  x := bounds.Min.X + anchorOffset( originalWidth, cropWidth, anchor.X )
+  y := bounds.Min.Y + anchorOffset( originalHeight, cropHeight, anchor.Y )
+
+  return image.Rect( x, y, x + cropWidth, y + cropHeight ), targetWidth, targetHeight
+}
+
+// smartCrop slides a window of the given size over the image and returns the
+// position that holds the largest share of the image's interest, together with
+// that share ( 0 to 1 ). interest combines edge density, saturation, and skin tones
+// measured on a downsampled copy; ties go to the window closest to the center
+func smartCrop( img image.Image, cropWidth int, cropHeight int ) ( image.Rectangle, float64 ) {
+  bounds := img.Bounds()
+  width := bounds.Dx()
+  height := bounds.Dy()
+  cropWidth = min( max( cropWidth, 1 ), width )
+  cropHeight = min( max( cropHeight, 1 ), height )
+
+  const analysisSize = 256
+  const edgeWeight = 1.0
+  const saturationWeight = 0.3
+  const skinWeight = 1.8
+
+  analysisScale := math.Min( 1, float64( analysisSize ) / float64( max( width, height ) ) )
+  analysisWidth := max( int( float64( width ) * analysisScale + 0.5 ), 1 )
+  analysisHeight := max( int( float64( height ) * analysisScale + 0.5 ), 1 )
+
+  analysis := image.NewRGBA( image.Rect( 0, 0, analysisWidth, analysisHeight ) )
+  boxKernel.Scale( analysis, analysis.Bounds(), img, bounds, draw.Src, nil )
+
+  luminance := make( []float64, analysisWidth * analysisHeight )
+  interest := make( []float64, analysisWidth * analysisHeight )
+
+  for y := 0; y < analysisHeight; y++ {
+    for x := 0; x < analysisWidth; x++ {
+      offset := analysis.PixOffset( x, y )
+      r := float64( analysis.Pix[ offset ] ) / 255
+      g := float64( analysis.Pix[ offset + 1 ] ) / 255
+      b := float64( analysis.Pix[ offset + 2 ] ) / 255
+      lightness := 0.299 * r + 0.587 * g + 0.114 * b
+      luminance[ y * analysisWidth + x ] = lightness
+
+      highest := math.Max( r, math.Max( g, b ) )
+      lowest := math.Min( r, math.Min( g, b ) )
+
+      saturation := 0.0
+      if highest > 0 {
+        saturation = ( highest - lowest ) / highest
+      }
+      if saturation > 0.4 && lightness > 0.05 && lightness < 0.9 {
+        interest[ y * analysisWidth + x ] += saturationWeight * ( saturation - 0.4 ) / 0.6
+      }
+
+      // skin tones sit close to a fixed chromaticity regardless of brightness
+      magnitude := math.Sqrt( r * r + g * g + b * b )
+      if magnitude > 0 && lightness > 0.2 {
+        dr := r / magnitude - 0.78
+        dg := g / magnitude - 0.57
+        db := b / magnitude - 0.44
+        skin := 1 - math.Sqrt( dr * dr + dg * dg + db * db )
+        if skin > 0.8 {
+          interest[ y * analysisWidth + x ] += skinWeight * ( skin - 0.8 ) / 0.2
+        }
+      }
+    }
+  }
+
+  // edges are the laplacian of the luminance, clamped to the image border
+  for y := 0; y < analysisHeight; y++ {
+    for x := 0; x < analysisWidth; x++ {
+      center := luminance[ y * analysisWidth + x ]
+      left := luminance[ y * analysisWidth + max( x - 1, 0 ) ]
+      right := luminance[ y * analysisWidth + min( x + 1, analysisWidth - 1 ) ]
+      up := luminance[ max( y - 1, 0 ) * analysisWidth + x ]
+      down := luminance[ min( y + 1, analysisHeight - 1 ) * analysisWidth + x ]
+      edge := math.Min( math.Abs( 4 * center - left - right - up - down ), 1 )
+      interest[ y * analysisWidth + x ] += edgeWeight * edge
+    }
+  }
+
+  // a summed-area table makes every window sum a constant time lookup
+  stride := analysisWidth + 1
+  summed := make( []float64, stride * ( analysisHeight + 1 ) )
+  for y := 0; y < analysisHeight; y++ {
+    rowSum := 0.0
+    for x := 0; x < analysisWidth; x++ {
+      rowSum += interest[ y * analysisWidth + x ]
+      summed[ ( y + 1 ) * stride + x + 1 ] = summed[ y * stride + x + 1 ] + rowSum
+    }
+  }
+  total := summed[ analysisHeight * stride + analysisWidth ]
+
+  windowWidth := min( max( int( float64( cropWidth ) * analysisScale + 0.5 ), 1 ), analysisWidth )
+  windowHeight := min( max( int( float64( cropHeight ) * analysisScale + 0.5 ), 1 ), analysisHeight )
+  centerX := float64( analysisWidth - windowWidth ) / 2
+  centerY := float64( analysisHeight - windowHeight ) / 2
+
+  bestX, bestY := 0, 0
+  bestScore := -1.0
+  bestDistance := math.Inf( 1 )
+
+  for y := 0; y + windowHeight <= analysisHeight; y++ {
+    for x := 0; x + windowWidth <= analysisWidth; x++ {
+      score := summed[ ( y + windowHeight ) * stride + x + windowWidth ] -
+        summed[ y * stride + x + windowWidth ] -
+        summed[ ( y + windowHeight ) * stride + x ] +
+        summed[ y * stride + x ]
+      distance := math.Hypot( float64( x ) - centerX, float64( y ) - centerY )
+
+      if score > bestScore + 1e-9 || ( math.Abs( score - bestScore ) <= 1e-9 && distance < bestDistance ) {
+        bestX, bestY = x, y
+        bestScore = score
+        bestDistance = distance
+      }
+    }
+  }
+
+  // floating point noise on flat images is not interest
+  share := 0.0
+  if total > 1e-6 {
+    share = math.Min( math.Max( bestScore / total, 0 ), 1 )
+  }
+
+  x := min( max( int( float64( bestX ) / analysisScale + 0.5 ), 0 ), width - cropWidth )
+  y := min( max( int( float64( bestY ) / analysisScale + 0.5 ), 0 ), height - cropHeight )
+
+  return image.Rect( x, y, x + cropWidth, y + cropHeight ).Add( bounds.Min ), share
+}
+
+// seamCarver resizes an image by removing or duplicating the connected paths of
+// pixels ( seams ) that carry the least visual energy, so that the important content
+// keeps its proportions. pixels are stored row by row as non-premultiplied rgba, in
+// the layout of image.NRGBA64 for 16-bit sources and of image.NRGBA otherwise
+type seamCarver struct {
+  width                 int
+  height                int
+  pixelBytes            int
+  pixels                []uint8
+  luminance             []float64
+  protection            []float64
+  origins               []int
+  cost                  []float64
+}
+
+// protected pixels get an energy far above anything a gradient can produce
+const seamProtectionEnergy = 1000
+
+func newSeamCarver( img image.Image, protect image.Image ) *seamCarver {
+  bounds := img.Bounds()
+  rect := image.Rect( 0, 0, bounds.Dx(), bounds.Dy() )
+  pixels, pixelBytes := []uint8( nil ), 4
+  if imageDepth( img ) == 16 {
+    nrgba := image.NewNRGBA64( rect )
+    draw.Draw( nrgba, rect, img, bounds.Min, draw.Src )
+    pixels, pixelBytes = nrgba.Pix, 8
+  } else {
+    nrgba := image.NewNRGBA( rect )
+    draw.Draw( nrgba, rect, img, bounds.Min, draw.Src )
+    pixels = nrgba.Pix
+  }
+
+  carver := &seamCarver{
+    width:      bounds.Dx(),
+    height:     bounds.Dy(),
+    pixelBytes: pixelBytes,
+    pixels:     pixels,
+    luminance:  make( []float64, bounds.Dx() * bounds.Dy() ),
+    protection: make( []float64, bounds.Dx() * bounds.Dy() ),
+  }
+
+  for index := range carver.luminance {
+    carver.luminance[ index ] = pixelLuminance( carver.pixel( index ) )
+  }
+
+  if protect != nil {
+    // the mask is stretched over the image; light, opaque mask pixels are protected
+    mask := image.NewGray( image.Rect( 0, 0, carver.width, carver.height ) )
+    draw.ApproxBiLinear.Scale( mask, mask.Bounds(), protect, protect.Bounds(), draw.Src, nil )
+    for index, value := range mask.Pix {
+      carver.protection[ index ] = float64( value ) / 255
+    }
+  }
+
+  return carver
+}
+
+func ( carver *seamCarver ) pixel( index int ) []uint8 {
+  return carver.pixels[ index * carver.pixelBytes : ( index + 1 ) * carver.pixelBytes ]
+}
+
+// pixelLuminance reads an 8-bit ( 4 byte ) or 16-bit ( 8 byte, big endian ) pixel
+func pixelLuminance( pixel []uint8 ) float64 {
+  if len( pixel ) == 8 {
+    r, g, b := int( pixel[ 0 ] ) << 8 | int( pixel[ 1 ] ), int( pixel[ 2 ] ) << 8 | int( pixel[ 3 ] ), int( pixel[ 4 ] ) << 8 | int( pixel[ 5 ] )
+    return ( 0.299 * float64( r ) + 0.587 * float64( g ) + 0.114 * float64( b ) ) / 0xffff
+  }
+  return ( 0.299 * float64( pixel[ 0 ] ) + 0.587 * float64( pixel[ 1 ] ) + 0.114 * float64( pixel[ 2 ] ) ) / 255
+}
+
+// blendPixels averages two pixels of the same layout, channel by channel
+func blendPixels( first []uint8, second []uint8 ) []uint8 {
+  blended := make( []uint8, len( first ) )
+  if len( first ) == 8 {
+    for channel := 0; channel < 8; channel += 2 {
+      value := ( int( first[ channel ] ) << 8 | int( first[ channel + 1 ] ) ) +
+        ( int( second[ channel ] ) << 8 | int( second[ channel + 1 ] ) )
+      value = ( value + 1 ) / 2
+      blended[ channel ], blended[ channel + 1 ] = uint8( value >> 8 ), uint8( value )
+    }
+    return blended
+  }
+
+  for channel := range blended {
+    blended[ channel ] = uint8( ( int( first[ channel ] ) + int( second[ channel ] ) + 1 ) / 2 )
+  }
+  return blended
+}
+
+func ( carver *seamCarver ) resizeWidth( target int ) {
+  for carver.width > target {
+    carver.removeSeam( carver.findSeam() )
+  }
+
+  // inserting more than half the width at once would duplicate the same seams over
+  // and over, so large enlargements are done in rounds
+  for carver.width < target {
+    carver.insertSeams( min( target - carver.width, max( carver.width / 2, 1 ) ) )
+  }
+}
+
+func ( carver *seamCarver ) energy() []float64 {
+  width := carver.width
+  height := carver.height
+  if cap( carver.cost ) < width * height {
+    carver.cost = make( []float64, width * height )
+  }
+  energy := carver.cost[ : width * height ]
+
+  for y := 0; y < height; y++ {
+    up := max( y - 1, 0 ) * width
+    down := min( y + 1, height - 1 ) * width
+    row := y * width
+    for x := 0; x < width; x++ {
+      left := max( x - 1, 0 )
+      right := min( x + 1, width - 1 )
+      energy[ row + x ] = math.Abs( carver.luminance[ row + right ] - carver.luminance[ row + left ] ) +
+        math.Abs( carver.luminance[ down + x ] - carver.luminance[ up + x ] ) +
+        carver.protection[ row + x ] * seamProtectionEnergy
+    }
+  }
+
+  return energy
+}
+
+// findSeam returns, for every row, the column of the vertical seam with the lowest
+// cumulative energy
+func ( carver *seamCarver ) findSeam() []int {
+  width := carver.width
+  height := carver.height
+  cost := carver.energy()
+
+  for y := 1; y < height; y++ {
+    previous := ( y - 1 ) * width
+    row := y * width
+    for x := 0; x < width; x++ {
+      best := cost[ previous + x ]
+      if x > 0 && cost[ previous + x - 1 ] < best {
+        best = cost[ previous + x - 1 ]
+      }
+      if x < width - 1 && cost[ previous + x + 1 ] < best {
+        best = cost[ previous + x + 1 ]
+      }
+      cost[ row + x ] += best
+    }
+  }
+
+  seam := make( []int, height )
+  last := ( height - 1 ) * width
+  for x := 1; x < width; x++ {
+    if cost[ last + x ] < cost[ last + seam[ height - 1 ] ] {
+      seam[ height - 1 ] = x
+    }
+  }
+
+  for y := height - 2; y >= 0; y-- {
+    row := y * width
+    next := seam[ y + 1 ]
+    seam[ y ] = next
+    if next > 0 && cost[ row + next - 1 ] < cost[ row + seam[ y ] ] {
+      seam[ y ] = next - 1
+    }
+    if next < width - 1 && cost[ row + next + 1 ] < cost[ row + seam[ y ] ] {
+      seam[ y ] = next + 1
+    }
+  }
+
+  return seam
+}
+
+func ( carver *seamCarver ) removeSeam( seam []int ) {
+  width := carver.width
+  newWidth := width - 1
+  size := carver.pixelBytes
+
+  // rows only ever move towards the start of the buffers, so the seam can be
+  // removed in place ( copy handles the overlap )
+  for y := 0; y < carver.height; y++ {
+    source := y * width
+    destination := y * newWidth
+    column := seam[ y ]
+
+    copy( carver.pixels[ destination * size : ( destination + column ) * size ],
+      carver.pixels[ source * size : ( source + column ) * size ] )
+    copy( carver.pixels[ ( destination + column ) * size : ( destination + newWidth ) * size ],
+      carver.pixels[ ( source + column + 1 ) * size : ( source + width ) * size ] )
+
+    removeSeamColumn( carver.luminance, source, destination, column, width )
+    removeSeamColumn( carver.protection, source, destination, column, width )
+    if carver.origins != nil {
+      removeSeamColumn( carver.origins, source, destination, column, width )
+    }
+  }
+
+  count := newWidth * carver.height
+  carver.width = newWidth
+  carver.pixels = carver.pixels[ : count * size ]
+  carver.luminance = carver.luminance[ : count ]
+  carver.protection = carver.protection[ : count ]
+  if carver.origins != nil {
+    carver.origins = carver.origins[ : count ]
+  }
+}
+
+func removeSeamColumn[ T any ]( values []T, source int, destination int, column int, width int ) {
+  copy( values[ destination : destination + column ], values[ source : source + column ] )
+  copy( values[ destination + column : destination + width - 1 ], values[ source + column + 1 : source + width ] )
+}
+
+// insertSeams finds the given number of lowest energy seams by carving them out of a
+// scratch copy, then duplicates each of them in the real image ( blending the seam
+// pixel with its right neighbour ) so the same low energy path is not chosen twice
+func ( carver *seamCarver ) insertSeams( count int ) {
+  width := carver.width
+  height := carver.height
+
+  scratch := &seamCarver{
+    width:      width,
+    height:     height,
+    pixelBytes: carver.pixelBytes,
+    pixels:     append( []uint8( nil ), carver.pixels... ),
+    luminance:  append( []float64( nil ), carver.luminance... ),
+    protection: append( []float64( nil ), carver.protection... ),
+    origins:    make( []int, width * height ),
+  }
+  for index := range scratch.origins {
+    scratch.origins[ index ] = index % width
+  }
+
+  duplicated := make( []bool, width * height )
+  for seamIndex := 0; seamIndex < count; seamIndex++ {
+    seam := scratch.findSeam()
+    for y, column := range seam {
+      duplicated[ y * width + scratch.origins[ y * scratch.width + column ] ] = true
+    }
+    scratch.removeSeam( seam )
+  }
+
+  newWidth := width + count
+  pixels := make( []uint8, 0, newWidth * height * carver.pixelBytes )
+  luminance := make( []float64, 0, newWidth * height )
+  protection := make( []float64, 0, newWidth * height )
+
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      index := y * width + x
+      pixel := carver.pixel( index )
+      pixels = append( pixels, pixel... )
+      luminance = append( luminance, carver.luminance[ index ] )
+      protection = append( protection, carver.protection[ index ] )
+
+      if duplicated[ index ] {
+        blended := blendPixels( pixel, carver.pixel( y * width + min( x + 1, width - 1 ) ) )
+        pixels = append( pixels, blended... )
+        luminance = append( luminance, pixelLuminance( blended ) )
+        protection = append( protection, carver.protection[ index ] )
+      }
+    }
+  }
+
+  carver.width = newWidth
+  carver.pixels = pixels
+  carver.luminance = luminance
+  carver.protection = protection
+}
+
+func ( carver *seamCarver ) transpose() {
+  width := carver.width
+  height := carver.height
+  pixels := make( []uint8, len( carver.pixels ) )
+  luminance := make( []float64, len( carver.luminance ) )
+  protection := make( []float64, len( carver.protection ) )
+
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      source := y * width + x
+      destination := x * height + y
+      copy( pixels[ destination * carver.pixelBytes : ( destination + 1 ) * carver.pixelBytes ], carver.pixel( source ) )
+      luminance[ destination ] = carver.luminance[ source ]
+      protection[ destination ] = carver.protection[ source ]
+    }
+  }
+
+  carver.width = height
+  carver.height = width
+  carver.pixels = pixels
+  carver.luminance = luminance
+  carver.protection = protection
+}
+
+func ( carver *seamCarver ) image() image.Image {
+  rect := image.Rect( 0, 0, carver.width, carver.height )
+  if carver.pixelBytes == 8 {
+    return &image.NRGBA64{ Pix: carver.pixels, Stride: carver.width * 8, Rect: rect }
+  }
+  return &image.NRGBA{ Pix: carver.pixels, Stride: carver.width * 4, Rect: rect }
+}
+
+// seamCarve resizes the image to exactly width by height, keeping the color model of
+// the source ( paletted images become NRGBA, since duplicated seams blend colors )
+func seamCarve( img image.Image, protect image.Image, width int, height int ) image.Image {
+  carver := newSeamCarver( img, protect )
+
+  carver.resizeWidth( width )
+
+  if height != carver.height {
+    carver.transpose()
+    carver.resizeWidth( height )
+    carver.transpose()
+  }
+
+  carved := carver.image()
+  canvas := newCanvas( img, carved.Bounds(), false )
+  if canvas.ColorModel() == carved.ColorModel() {
+    return carved
+  }
+  draw.Draw( canvas, canvas.Bounds(), carved, image.Point{}, draw.Src )
+  return canvas
+}
+
+// parseFuzz reads a color tolerance given as a percentage, with or without the % sign
+func parseFuzz( value string ) ( float64, error ) {
+  normalized := strings.TrimSuffix( strings.TrimSpace( value ), "%" )
+  if normalized == "" {
+    return 0, nil
+  }
+
+  fuzz, err := strconv.ParseFloat( normalized, 64 )
+  if err != nil || math.IsNaN( fuzz ) || fuzz < 0 || fuzz > 100 {
+    return 0, fmt.Errorf( "The fuzz %s is not valid (expected a percentage from 0 to 100).", value )
+  }
+
+  return fuzz, nil
+}
+
+func rgba64At( img image.Image, x int, y int ) color.RGBA64 {
+  if direct, ok := img.( image.RGBA64Image ); ok {
+    return direct.RGBA64At( x, y )
+  }
+  r, g, b, a := img.At( x, y ).RGBA()
+  return color.RGBA64{ uint16( r ), uint16( g ), uint16( b ), uint16( a ) }
+}
+
+// colorsWithin reports whether two colors differ by at most fuzz percent of the largest
+// possible distance; premultiplied values make all fully transparent colors equal
+func colorsWithin( first color.RGBA64, second color.RGBA64, fuzz float64 ) bool {
+  difference := func( a uint16, b uint16 ) float64 {
+    return float64( a ) - float64( b )
+  }
+
+  r, g, b, a := difference( first.R, second.R ), difference( first.G, second.G ),
+    difference( first.B, second.B ), difference( first.A, second.A )
+  limit := fuzz / 100 * 0xffff
+  return ( r * r + g * g + b * b + a * a ) / 4 <= limit * limit
+}
+
+// detectBackground picks the corner color shared by the most corners ( within the fuzz ),
+// preferring the top left corner on ties
+func detectBackground( img image.Image, fuzz float64 ) color.RGBA64 {
+  bounds := img.Bounds()
+  corners := []color.RGBA64{
+    rgba64At( img, bounds.Min.X, bounds.Min.Y ),
+    rgba64At( img, bounds.Max.X - 1, bounds.Min.Y ),
+    rgba64At( img, bounds.Min.X, bounds.Max.Y - 1 ),
+    rgba64At( img, bounds.Max.X - 1, bounds.Max.Y - 1 ),
+  }
+
+  best, bestCount := corners[ 0 ], 0
+  for _, corner := range corners {
+    count := 0
+    for _, other := range corners {
+      if colorsWithin( corner, other, fuzz ) {
+        count++
+      }
+    }
+    if count > bestCount {
+      best, bestCount = corner, count
+    }
+  }
+
+  return best
+}
+
+// maskRegion maps a rectangle of the image onto a mask stretched over it, rounding
+// outwards; integer math keeps edges on the image's edges exactly on the mask's edges
+func maskRegion( rect image.Rectangle, imageBounds image.Rectangle, maskBounds image.Rectangle ) image.Rectangle {
+  scale := func( offset int, maskSize int, size int, roundUp bool ) int {
+    if roundUp {
+      return ( offset * maskSize + size - 1 ) / size
+    }
+    return offset * maskSize / size
+  }
+
+  width, height := imageBounds.Dx(), imageBounds.Dy()
+  return image.Rect(
+    maskBounds.Min.X + scale( rect.Min.X - imageBounds.Min.X, maskBounds.Dx(), width, false ),
+    maskBounds.Min.Y + scale( rect.Min.Y - imageBounds.Min.Y, maskBounds.Dy(), height, false ),
+    maskBounds.Min.X + scale( rect.Max.X - imageBounds.Min.X, maskBounds.Dx(), width, true ),
+    maskBounds.Min.Y + scale( rect.Max.Y - imageBounds.Min.Y, maskBounds.Dy(), height, true ),
+  ).Intersect( maskBounds )
+}
+
+// trimBounds returns the smallest rectangle holding every pixel that differs from the
+// background by more than the fuzz, or an empty rectangle if there is none
+func trimBounds( img image.Image, background color.RGBA64, fuzz float64 ) image.Rectangle {
+  bounds := img.Bounds()
+  isBackground := func( x0 int, y0 int, x1 int, y1 int ) bool {
+    for y := y0; y < y1; y++ {
+      for x := x0; x < x1; x++ {
+        if !colorsWithin( rgba64At( img, x, y ), background, fuzz ) {
+          return false
+        }
+      }
+    }
+    return true
+  }
+
+  top := bounds.Min.Y
+  for top < bounds.Max.Y && isBackground( bounds.Min.X, top, bounds.Max.X, top + 1 ) {
+    top++
+  }
+  if top == bounds.Max.Y {
+    return image.Rectangle{}
+  }
+
+  // the scans below always stop at the row or column found by the one before
+  bottom := bounds.Max.Y
+  for isBackground( bounds.Min.X, bottom - 1, bounds.Max.X, bottom ) {
+    bottom--
+  }
+
+  left := bounds.Min.X
+  for isBackground( left, top, left + 1, bottom ) {
+    left++
+  }
+
+  right := bounds.Max.X
+  for isBackground( right - 1, top, right, bottom ) {
+    right--
+  }
+
+  return image.Rect( left, top, right, bottom )
+}
+
+func formatColor( value color.Color ) string {
+  converted := color.NRGBAModel.Convert( value ).( color.NRGBA )
+  if converted.A == 0xff {
+    return fmt.Sprintf( "#%02x%02x%02x", converted.R, converted.G, converted.B )
+  }
+  return fmt.Sprintf( "#%02x%02x%02x%02x", converted.R, converted.G, converted.B, converted.A )
+}
+
+// skew detection runs on a reduced copy, small enough to search quickly while
+// keeping lines of text several pixels tall
+const skewAnalysisSize = 1024
+
+// detectSkew estimates how far the content is rotated clockwise, in degrees within
+// maxAngle either way. the ink pixels are projected onto the vertical axis at each
+// candidate angle, and the angle whose profile changes most sharply from row to row
+// ( lines of text against the gaps between them ) wins; zero means no clear skew
+func detectSkew( img image.Image, maxAngle float64 ) float64 {
+  bounds := img.Bounds()
+  analysisScale := math.Min( 1, float64( skewAnalysisSize ) / float64( max( bounds.Dx(), bounds.Dy() ) ) )
+  width := max( int( float64( bounds.Dx() ) * analysisScale + 0.5 ), 1 )
+  height := max( int( float64( bounds.Dy() ) * analysisScale + 0.5 ), 1 )
+
+  // composite over white so that transparent areas count as paper
+  analysis := image.NewRGBA( image.Rect( 0, 0, width, height ) )
+  draw.Draw( analysis, analysis.Bounds(), image.White, image.Point{}, draw.Src )
+  boxKernel.Scale( analysis, analysis.Bounds(), img, bounds, draw.Over, nil )
+
+  luminance := make( []uint8, width * height )
+  var histogram [ 256 ]int
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      offset := analysis.PixOffset( x, y )
+      value := ( 299 * int( analysis.Pix[ offset ] ) + 587 * int( analysis.Pix[ offset + 1 ] ) +
+        114 * int( analysis.Pix[ offset + 2 ] ) + 500 ) / 1000
+      luminance[ y * width + x ] = uint8( value )
+      histogram[ value ]++
+    }
+  }
+
+  // the ink is whichever side of the threshold covers fewer pixels, so light text on
+  // a dark background works as well
+  threshold := otsuThreshold( histogram )
+  darkCount := 0
+  for value := 0; value <= threshold; value++ {
+    darkCount += histogram[ value ]
+  }
+  inkIsDark := darkCount * 2 <= width * height
+
+  // ink coordinates relative to the center, thinned out on very busy pages
+  const maxPoints = 200000
+  var points [][ 2 ]float64
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      if ( int( luminance[ y * width + x ] ) <= threshold ) == inkIsDark {
+        points = append( points, [ 2 ]float64{ float64( x ) - float64( width ) / 2, float64( y ) - float64( height ) / 2 } )
+      }
+    }
+  }
+  if len( points ) == 0 || len( points ) == width * height {
+    return 0
+  }
+  if len( points ) > maxPoints {
+    step := len( points ) / maxPoints + 1
+    thinned := points[ :0 ]
+    for index := 0; index < len( points ); index += step {
+      thinned = append( thinned, points[ index ] )
+    }
+    points = thinned
+  }
+
+  bins := make( []int, int( math.Hypot( float64( width ), float64( height ) ) ) + 2 )
+  center := float64( len( bins ) ) / 2
+  sharpness := func( skew float64 ) int64 {
+    clear( bins )
+    // undo the candidate skew and project onto the vertical axis
+    sin, cos := math.Sincos( -skew * math.Pi / 180 )
+    for _, point := range points {
+      bins[ int( point[ 0 ] * sin + point[ 1 ] * cos + center ) ]++
+    }
+
+    var total int64
+    for index := 1; index < len( bins ); index++ {
+      difference := int64( bins[ index ] - bins[ index - 1 ] )
+      total += difference * difference
+    }
+    return total
+  }
+
+  // search outwards from the middle so that ties ( such as a blank page ) keep the
+  // smallest angle; a coarse pass is refined around the best coarse angle
+  search := func( middle float64, reach float64, step float64 ) float64 {
+    best, bestScore := middle, sharpness( middle )
+    for distance := step; distance <= reach + 1e-9; distance += step {
+      for _, candidate := range []float64{ middle + distance, middle - distance } {
+        if math.Abs( candidate ) > maxAngle + 1e-9 {
+          continue
+        }
+        if score := sharpness( candidate ); score > bestScore {
+          best, bestScore = candidate, score
+        }
+      }
+    }
+    return best
+  }
+
+  skew := search( 0, maxAngle, 0.5 )
+  skew = search( skew, 0.5, 0.05 )
+
+  // two decimals is well beyond the precision of the search; the comparison also
+  // turns a negative zero into a plain zero
+  skew = math.Round( skew * 100 ) / 100
+  if skew == 0 {
+    return 0
+  }
+  return skew
+}
+
+// otsuThreshold returns the luminance that best separates the histogram into a dark
+// class ( values up to and including it ) and a light class
+func otsuThreshold( histogram [ 256 ]int ) int {
+  total, weightedTotal := 0, 0.0
+  for value, count := range histogram {
+    total += count
+    weightedTotal += float64( value * count )
+  }
+
+  threshold, bestVariance := 0, -1.0
+  darkCount, darkSum := 0, 0.0
+  for value := 0; value < 255; value++ {
+    darkCount += histogram[ value ]
+    darkSum += float64( value * histogram[ value ] )
+    lightCount := total - darkCount
+    if darkCount == 0 || lightCount == 0 {
+      continue
+    }
+
+    darkMean := darkSum / float64( darkCount )
+    lightMean := ( weightedTotal - darkSum ) / float64( lightCount )
+    variance := float64( darkCount ) * float64( lightCount ) * ( darkMean - lightMean ) * ( darkMean - lightMean )
+    if variance > bestVariance {
+      threshold, bestVariance = value, variance
+    }
+  }
+
+  return threshold
+}
+
+func transformImageCommand( context *cli.Context ) error {
+  useJSON := context.Bool( "json" )
+  result, err := transformImage( context )
+
+  if err != nil {
+    outputError( err.Error(), useJSON )
+    return err
+  }
+
+  if useJSON {
+    outputSuccess( result, useJSON )
+  } else {
+    fmt.Println( result.Message )
+    fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+  }
+
+  return nil
+}
+
+func transformImage( context *cli.Context ) ( *TransformResult, error ) {
+  if context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 2 arguments (input and output), but got %d.", context.NArg() )
+  }
+
+  inputPath := context.Args().Get( 0 )
+  outputPath := context.Args().Get( 1 )
+  maxWidth := context.Int( "width" )
+  maxHeight := context.Int( "height" )
+  quality := context.Int( "quality" )
+  noEnlarge := context.Bool( "no-enlarge" )
+  rotate := context.Float64( "rotate" )
+  expand := context.Bool( "expand" )
+  depth := context.Int( "depth" )
+  trim := context.Bool( "trim" )
+
+  fuzz, err := parseFuzz( context.String( "fuzz" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  mode := strings.ToLower( context.String( "mode" ) )
+
+  linear := context.Bool( "linear" )
+
+  threads := context.Int( "threads" )
+  if threads < 0 {
+    return nil, fmt.Errorf( "Threads cannot be negative, but got %d.", threads )
+  }
+  if threads == 0 {
+    threads = runtime.GOMAXPROCS( 0 )
+  }
+
+  filter, filterName, err := parseFilter( context.String( "filter" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  anchor, err := parseGravity( context.String( "gravity" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  background, err := parseColor( context.String( "background" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  scale, err := parseScale( context.String( "scale" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  protectPath := context.String( "protect" )
+
+  if mode != "fit" && mode != "cover" && mode != "pad" && mode != "stretch" && mode != "seam" {
+    return nil, fmt.Errorf( "The mode %s is not supported (expected fit, cover, pad, stretch, or seam).", mode )
+  }
+
+  if protectPath != "" && mode != "seam" {
+    return nil, fmt.Errorf( "A protect mask can only be used with the seam mode." )
+  }
+
+  if scale > 0 && ( maxWidth != 0 || maxHeight != 0 ) {
+    return nil, fmt.Errorf( "The scale option cannot be combined with width or height." )
+  }
+
+  if scale > 0 && mode != "fit" {
+    return nil, fmt.Errorf( "The scale option cannot be combined with the %s mode.", mode )
+  }
+
+  maxPixels, err := parsePixelCount( context.String( "max-pixels" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  limits := sizeLimits{
+    MaxPixels:    maxPixels,
+    MaxLongEdge:  context.Int( "max-long-edge" ),
+    MaxShortEdge: context.Int( "max-short-edge" ),
+  }
+
+  if limits.MaxLongEdge < 0 || limits.MaxShortEdge < 0 {
+    return nil, fmt.Errorf( "Edge limits cannot be negative." )
+  }
+
+  if limits.active() && mode != "fit" {
+    return nil, fmt.Errorf( "Pixel and edge limits cannot be combined with the %s mode.", mode )
+  }
+
+  if ( mode == "cover" || mode == "pad" ) && ( maxWidth == 0 || maxHeight == 0 ) {
+    return nil, fmt.Errorf( "The %s mode requires both width and height.", mode )
+  }
+
+  if anchor.Smart && mode != "cover" {
+    return nil, fmt.Errorf( "The smart gravity is only supported in cover mode." )
+  }
+
+  if math.IsNaN( rotate ) || math.IsInf( rotate, 0 ) {
+    return nil, fmt.Errorf( "Rotation must be a finite number of degrees." )
+  }
+  rotate = normalizeAngle( rotate )
+
+  // seams are removed or duplicated whole, so there is nothing to resample
+  if mode == "seam" {
+    if linear {
+      return nil, fmt.Errorf( "The linear option cannot be combined with the seam mode, which does not resample the image." )
+    }
+    if context.IsSet( "filter" ) && math.Mod( rotate, 90 ) == 0 {
+      return nil, fmt.Errorf( "The filter option cannot be combined with the seam mode unless the image is rotated " +
+        "by an angle that is not a multiple of 90 degrees." )
+    }
+  }
+
+  // rotation comes first, then the mirrors in a fixed order
+  var geometry []string
+  mirror := identityOrientation
+  if rotate != 0 {
+    geometry = append( geometry, fmt.Sprintf( "rotate %g", rotate ) )
+  }
+  for _, operation := range []struct {
+    name                string
+    orientation         orientation
+  }{
+    { "flip", flipOrientation },
+    { "flop", flopOrientation },
+    { "transpose", transposeOrientation },
+    { "transverse", transverseOrientation },
+  } {
+    if context.Bool( operation.name ) {
+      geometry = append( geometry, operation.name )
+      mirror = mirror.then( operation.orientation )
+    }
+  }
+
+  if maxWidth < 0 {
+    return nil, fmt.Errorf( "Width cannot be negative, but got %d.", maxWidth )
+  }
+
+  if maxHeight < 0 {
+    return nil, fmt.Errorf( "Height cannot be negative, but got %d.", maxHeight )
+  }
+
+  if quality < 0 || quality > 100 {
+    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
+  }
+
+  autoOrient := !context.Bool( "no-auto-orient" )
+  sourceImage, format, _, err := loadOrientedImage( inputPath, autoOrient )
+  if err != nil {
+    return nil, fmt.Errorf( "The image file %s could not be decoded (possibly corrupt or unsupported format): %w",
+      inputPath, err )
+  }
+
+  if sourceImage == nil {
+    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
+  }
+
+  outputExtension := strings.ToLower( filepath.Ext( outputPath ) )
+  if err := validateDepth( depth, outputExtension, format ); err != nil {
+    return nil, err
+  }
+  sourceImage = convertDepth( sourceImage, depth )
+
+  var protectImage image.Image
+  if protectPath != "" {
+    protectImage, _, _, err = loadOrientedImage( protectPath, autoOrient )
+    if err != nil {
+      return nil, fmt.Errorf( "The protect mask %s could not be decoded (possibly corrupt or unsupported format): %w",
+        protectPath, err )
+    }
+  }
+
+  // apply rotation and mirroring before resizing, as one exact pass for right angles
+  orient := func( img image.Image, background color.Color ) image.Image {
+    if math.Mod( rotate, 90 ) == 0 {
+      return orientImage( img, rotationOrientation( int( rotate ) ).then( mirror ) )
+    }
+    return orientImage( rotateAnyAngle( img, rotate, expand, background, filter ), mirror )
+  }
+
+  sourceImage = orient( sourceImage, background )
+  if protectImage != nil {
+    // uncovered corners of the mask are left unprotected
+    protectImage = orient( protectImage, color.Black )
+  }
+
+  var trimRegion *Region
+  if trim {
+    trimmedBounds := sourceImage.Bounds()
+    content := trimBounds( sourceImage, detectBackground( sourceImage, fuzz ), fuzz )
+    if content.Empty() {
+      return nil, fmt.Errorf( "The image %s only contains its background color, so there is nothing left after trimming.",
+        inputPath )
+    }
+
+    if protectImage != nil {
+      // the mask is stretched over the image, so cut the matching share of it
+      protectImage = cropImage( protectImage, maskRegion( content, trimmedBounds, protectImage.Bounds() ) )
+    }
+
+    sourceImage = cropImage( sourceImage, content )
+    region := content.Sub( trimmedBounds.Min )
+    trimRegion = &Region{ X1: region.Min.X, Y1: region.Min.Y, X2: region.Max.X, Y2: region.Max.Y }
+  }
+
+  bounds := sourceImage.Bounds()
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
+
+  if originalWidth <= 0 || originalHeight <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
+      inputPath, originalWidth, originalHeight )
+  }
+
+  if originalWidth > maxDimension || originalHeight > maxDimension {
+    return nil, fmt.Errorf( "The image %s is too large: %dx%d (maximum dimension is %d).",
+      inputPath, originalWidth, originalHeight, maxDimension )
+  }
+
+  var destinationImage image.Image
+  var targetWidth, targetHeight int
+  var resized bool
+  var message string
+  var cropRegion *Region
+  var cropScore *float64
+  var placementOffset *Point
+
+  if scale > 0 {
+    if float64( originalWidth ) * scale > maxDimension || float64( originalHeight ) * scale > maxDimension {
+      return nil, fmt.Errorf( "Scaling %dx%d by %g exceeds the maximum dimension of %d.",
+        originalWidth, originalHeight, scale, maxDimension )
+    }
+  }
+
+  if maxWidth == 0 && maxHeight == 0 && scale == 0 && !limits.active() {
+    message = fmt.Sprintf( "Converting %s [%s] %dx%d (no resize)",
+      filepath.Base( inputPath ),
+      format,
+      originalWidth,
+      originalHeight,
+    )
+    destinationImage = sourceImage
+    targetWidth = originalWidth
+    targetHeight = originalHeight
+    resized = false
+  } else {
+    sourceRect := bounds
+    var contentWidth, contentHeight int
+    var placement image.Point
+
+    switch mode {
+    case "cover":
+      sourceRect, targetWidth, targetHeight = coverRegion( bounds, maxWidth, maxHeight, anchor, noEnlarge )
+      if anchor.Smart {
+        var score float64
+        sourceRect, score = smartCrop( sourceImage, sourceRect.Dx(), sourceRect.Dy() )
+        cropScore = &score
+      }
+      cropRegion = &Region{
+        X1: sourceRect.Min.X - bounds.Min.X,
+        Y1: sourceRect.Min.Y - bounds.Min.Y,
+        X2: sourceRect.Max.X - bounds.Min.X,
+        Y2: sourceRect.Max.Y - bounds.Min.Y,
+      }
+      contentWidth, contentHeight = targetWidth, targetHeight
+    case "pad":
+      contentWidth, contentHeight = fitDimensions( originalWidth, originalHeight, maxWidth, maxHeight, noEnlarge )
+      targetWidth, targetHeight = maxWidth, maxHeight
+      placement = image.Pt(
+        anchorOffset( targetWidth, contentWidth, anchor.X ),
+        anchorOffset( targetHeight, contentHeight, anchor.Y ),
+      )
+      placementOffset = &Point{ X: placement.X, Y: placement.Y }
+    case "stretch", "seam":
+      targetWidth, targetHeight = stretchDimensions( originalWidth, originalHeight, maxWidth, maxHeight, noEnlarge )
+      contentWidth, contentHeight = targetWidth, targetHeight
+    default:
+      if scale > 0 {
+        targetWidth, targetHeight = scaleDimensions( originalWidth, originalHeight, scale, noEnlarge )
+      } else if maxWidth > 0 || maxHeight > 0 {
+        targetWidth, targetHeight = fitDimensions( originalWidth, originalHeight, maxWidth, maxHeight, noEnlarge )
+      } else {
+        targetWidth, targetHeight = originalWidth, originalHeight
+      }
+      targetWidth, targetHeight = limits.constrain( targetWidth, targetHeight )
+      contentWidth, contentHeight = targetWidth, targetHeight
+    }
+
+    if targetWidth <= 0 || targetHeight <= 0 {
+      return nil, fmt.Errorf( "Calculated target dimensions are invalid: %dx%d.",
+        targetWidth, targetHeight )
+    }
+
+    if targetWidth > maxDimension || targetHeight > maxDimension {
+      return nil, fmt.Errorf( "Target dimensions %dx%d exceed maximum dimension of %d.",
+        targetWidth, targetHeight, maxDimension )
+    }
+
+    if targetWidth == originalWidth && targetHeight == originalHeight && sourceRect == bounds {
+      message = fmt.Sprintf( "Converting %s [%s] %dx%d (no resize needed)",
+        filepath.Base( inputPath ),
+        format,
+        originalWidth,
+        originalHeight,
+      )
+      destinationImage = sourceImage
+      resized = false
+    } else {
+      resizeMode := "maintaining aspect ratio"
+      if mode == "cover" {
+        resizeMode = fmt.Sprintf( "cover %dx%d, %s gravity", maxWidth, maxHeight, anchor.Name )
+      } else if mode == "pad" {
+        resizeMode = fmt.Sprintf( "pad %dx%d content, %s gravity", contentWidth, contentHeight, anchor.Name )
+      } else if mode == "stretch" {
+        resizeMode = "stretch, ignoring aspect ratio"
+      } else if mode == "seam" {
+        resizeMode = "seam carving"
+        if protectPath != "" {
+          resizeMode += ", protected by " + filepath.Base( protectPath )
+        }
+      } else if scale > 0 {
+        resizeMode = fmt.Sprintf( "scale %g%%", scale * 100 )
+      } else if maxWidth > 0 && maxHeight > 0 {
+        resizeMode = fmt.Sprintf( "fit within %dx%d", maxWidth, maxHeight )
+      }
+      if limits.active() {
+        resizeMode += ", " + limits.String()
+      }
+      if noEnlarge {
+        resizeMode += ", no enlargement"
+      }
+      if mode != "seam" {
+        resizeMode += ", " + filterName + " filter"
+        if linear {
+          resizeMode += " in linear light"
+        }
+      }
+
+      message = fmt.Sprintf( "Resizing %s [%s] from %dx%d to %dx%d (%s)",
+        filepath.Base( inputPath ),
+        format,
+        originalWidth,
+        originalHeight,
+        targetWidth,
+        targetHeight,
+        resizeMode,
+      )
+
+      destinationImage = sourceImage
+      if mode == "seam" {
+        destinationImage = seamCarve( sourceImage, protectImage, contentWidth, contentHeight )
+      } else if contentWidth != originalWidth || contentHeight != originalHeight || sourceRect != bounds {
+        destinationImage = resizeImage( sourceImage, sourceRect, contentWidth, contentHeight, resizeOptions{
+          Filter:  filter,
+          Linear:  linear,
+          Threads: threads,
+        } )
+      }
+
+      if mode == "pad" {
+        destinationImage = padImage( destinationImage, targetWidth, targetHeight, placement,
+          opaqueBackground( background, outputExtension, format ) )
+      }
+      resized = true
+    }
+  }
+
+  err = encodeOutput( outputPath, outputExtension, destinationImage, quality, format )
+  if err != nil {
+    return nil, fmt.Errorf( "The output file %s could not be written: %w", outputPath, err )
+  }
+
+  return &TransformResult{
+    InputFile:  inputPath,
+    OutputFile: outputPath,
+    Format:     format,
+    OriginalSize: Size{
+      Width:  originalWidth,
+      Height: originalHeight,
+    },
+    FinalSize: Size{
+      Width:  targetWidth,
+      Height: targetHeight,
+    },
+    Resized:         resized,
+    Mode:            mode,
+    CropRegion:      cropRegion,
+    CropScore:       cropScore,
+    PlacementOffset: placementOffset,
+    TrimRegion:      trimRegion,
+    Rotation:        rotate,
+    Geometry:        geometry,
+    Filter:          filterName,
+    LinearLight:     linear,
+    ColorModel:      colorModelName( destinationImage ),
+    Message:         message,
+  }, nil
+}
+
+func imageInfoCommand( context *cli.Context ) error {
+  useJSON := context.Bool( "json" )
+  result, err := imageInfo( context )
+
+  if err != nil {
+    outputError( err.Error(), useJSON )
+    return err
+  }
+
+  if useJSON {
+    outputSuccess( result, useJSON )
+  } else {
+    fmt.Printf( "File:         %s\n", result.File )
+    fmt.Printf( "Path:         %s\n", result.Path )
+    fmt.Printf( "Format:       %s\n", strings.ToUpper( result.Format ) )
+    fmt.Printf( "Dimensions:   %d × %d pixels\n", result.Width, result.Height )
+    fmt.Printf( "Aspect Ratio: %.2f:1\n", result.AspectRatio )
+    fmt.Printf( "Transparency: %v\n", result.HasAlpha )
+    fmt.Printf( "Color Model:  %s\n", result.ColorModel )
+    fmt.Printf( "Orientation:  %d\n", result.Orientation )
+    fmt.Printf( "File Size:    %d bytes (%.2f KB)\n", result.FileSize, result.FileSizeKB )
+  }
+
+  return nil
+}
+
+func imageInfo( context *cli.Context ) ( *InfoResult, error ) {
+  if context.NArg() != 1 {
+    return nil, fmt.Errorf( "Expected 1 argument (input file), but got %d.", context.NArg() )
+  }
+
+  inputPath := context.Args().Get( 0 )
+
+  fileInfo, err := os.Stat( inputPath )
+  if err != nil {
+    return nil, fmt.Errorf( "The file %s could not be accessed: %w", inputPath, err )
+  }
+
+  if fileInfo.Size() == 0 {
+    return nil, fmt.Errorf( "The file %s is empty.", inputPath )
+  }
+
+  sourceImage, format, orientation, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
+  if err != nil {
+    return nil, fmt.Errorf( "The image file %s could not be decoded (possibly corrupt or unsupported format): %w",
+      inputPath,
+      err )
+  }
+
+  if sourceImage == nil {
+    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
+  }
+
+  bounds := sourceImage.Bounds()
+  width := bounds.Dx()
+  height := bounds.Dy()
+
+  if width <= 0 || height <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.", inputPath, width, height )
+  }
+
+  hasAlpha := false
+  switch sourceImage.( type ) {
+  case *image.NRGBA, *image.NRGBA64, *image.RGBA, *image.RGBA64, *image.Alpha, *image.Alpha16:
+    hasAlpha = true
+  }
+
+  aspectRatio := float64( width ) / float64( height )
+
+  return &InfoResult{
+    File:        filepath.Base( inputPath ),
+    Path:        inputPath,
+    Format:      format,
+    Width:       width,
+    Height:      height,
+    AspectRatio: aspectRatio,
+    HasAlpha:    hasAlpha,
+    ColorModel:  colorModelName( sourceImage ),
+    Orientation: orientation,
+    FileSize:    fileInfo.Size(),
+    FileSizeKB:  float64( fileInfo.Size() ) / 1024.0,
+  }, nil
+}
+
+func clipImageCommand( context *cli.Context ) error {
+  useJSON := context.Bool( "json" )
+  if context.String( "regions" ) != "" {
+    return clipRegionsCommand( context )
+  }
+
+  result, err := clipImage( context )
+
+  if err != nil {
+    outputError( err.Error(), useJSON )
+    return err
+  }
+
+  if useJSON {
+    outputSuccess( result, useJSON )
+  } else {
+    fmt.Println( result.Message )
+    fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+  }
+
+  return nil
+}
+
+func clipImage( context *cli.Context ) ( *ClipResult, error ) {
+  if context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 2 arguments ( input and output ), but got %d.", context.NArg() )
+  }
+
+  inputPath := context.Args().Get( 0 )
+  outputPath := context.Args().Get( 1 )
+  x1 := context.Int( "x1" )
+  y1 := context.Int( "y1" )
+  x2 := context.Int( "x2" )
+  y2 := context.Int( "y2" )
+  quality := context.Int( "quality" )
+  mode := strings.ToLower( context.String( "mode" ) )
+  xValue := context.String( "x" )
+  yValue := context.String( "y" )
+  widthValue := context.String( "width" )
+  heightValue := context.String( "height" )
+  gravityName := context.String( "gravity" )
+  aspectValue := context.String( "aspect" )
+  depth := context.Int( "depth" )
+
+  if quality < 0 || quality > 100 {
+    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
+  }
+
+  overflow, background, err := parseOverflow( context.String( "overflow" ), context.String( "background" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  shape, err := parseShape( context.String( "ellipse" ), context.String( "polygon" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  corners := context.IsSet( "x1" ) || context.IsSet( "y1" ) || context.IsSet( "x2" ) || context.IsSet( "y2" )
+  relative := xValue != "" || yValue != "" || widthValue != "" || heightValue != "" || gravityName != ""
+
+  var anchor *gravity
+  if gravityName != "" {
+    parsed, err := parseGravity( gravityName )
+    if err != nil {
+      return nil, err
+    }
+    if parsed.Smart && aspectValue == "" {
+      return nil, fmt.Errorf( "The smart gravity is only supported by clip with an aspect ratio ( use --mode smart instead )." )
+    }
+    anchor = &parsed
+  }
+
+  aspect := 0.0
+  if aspectValue != "" {
+    parsed, err := parseAspect( aspectValue )
+    if err != nil {
+      return nil, err
+    }
+    aspect = parsed
+
+    if corners || xValue != "" || yValue != "" || widthValue != "" || heightValue != "" {
+      return nil, fmt.Errorf( "The aspect option cannot be combined with coordinates, width, or height." )
+    }
+
+    // choosing the placement by content is what the smart mode does
+    if anchor != nil && anchor.Smart {
+      mode, anchor = "smart", nil
+    }
+  }
+
+  if shape != nil {
+    if corners || relative || aspect > 0 || mode != "rect" {
+      return nil, fmt.Errorf( "The ellipse and polygon options define the region themselves and cannot be combined " +
+        "with coordinates, gravity, an aspect ratio, or the smart mode." )
+    }
+
+    bounds, err := shape.bounds()
+    if err != nil {
+      return nil, err
+    }
+    x1, y1, x2, y2 = bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y
+    if bounds.Empty() {
+      return nil, fmt.Errorf( "The %s ( %d,%d )-( %d,%d ) has no area.", shape.Name, x1, y1, x2, y2 )
+    }
+  }
+
+  switch mode {
+  case "rect":
+    if corners && relative {
+      return nil, fmt.Errorf( "The x1, y1, x2, and y2 coordinates cannot be combined with x, y, width, height, or gravity." )
+    }
+
+    if !relative && aspect == 0 && shape == nil {
+      if !context.IsSet( "x1" ) || !context.IsSet( "y1" ) || !context.IsSet( "x2" ) || !context.IsSet( "y2" ) {
+        return nil, fmt.Errorf( "The rect mode requires the x1, y1, x2, and y2 coordinates, " +
+          "a region given by x, y, width, height, or gravity, an aspect ratio, or an ellipse or polygon." )
+      }
+
+      if overflow == "error" && ( x1 < 0 || y1 < 0 || x2 < 0 || y2 < 0 ) {
+        return nil, fmt.Errorf( "Coordinates cannot be negative." )
+      }
+
+      if x2 <= x1 {
+        return nil, fmt.Errorf( "x2 must be greater than x1 ( got x1=%d, x2=%d ).", x1, x2 )
+      }
+
+      if y2 <= y1 {
+        return nil, fmt.Errorf( "y2 must be greater than y1 ( got y1=%d, y2=%d ).", y1, y2 )
+      }
+    }
+  case "smart":
+    if aspect == 0 && ( widthValue == "" || heightValue == "" ) {
+      return nil, fmt.Errorf( "The smart mode requires a width and height, or an aspect ratio." )
+    }
+    if corners || xValue != "" || yValue != "" || anchor != nil {
+      return nil, fmt.Errorf( "The smart mode chooses the position itself and cannot be combined with coordinates or gravity." )
+    }
+  default:
+    return nil, fmt.Errorf( "The mode %s is not supported ( expected rect or smart ).", mode )
+  }
+
+  sourceImage, format, _, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
+  if err != nil {
+    return nil, fmt.Errorf(
+      "The image file %s could not be decoded ( possibly corrupt or unsupported format ): %w",
+      inputPath, err )
+  }
+
+  if sourceImage == nil {
+    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
+  }
+
+  outputExtension := strings.ToLower( filepath.Ext( outputPath ) )
+  if err := validateDepth( depth, outputExtension, format ); err != nil {
+    return nil, err
+  }
+  sourceImage = convertDepth( sourceImage, depth )
+
+  bounds := sourceImage.Bounds()
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
+
+  if originalWidth <= 0 || originalHeight <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
+      inputPath, originalWidth, originalHeight )
+  }
+
+  if mode == "rect" && aspect > 0 {
+    if anchor == nil {
+      centered, _ := parseGravity( "center" )
+      anchor = &centered
+    }
+
+    clipWidth, clipHeight := aspectSize( originalWidth, originalHeight, aspect )
+    x1 = anchorOffset( originalWidth, clipWidth, anchor.X )
+    y1 = anchorOffset( originalHeight, clipHeight, anchor.Y )
+    x2, y2 = x1 + clipWidth, y1 + clipHeight
+  } else if mode == "rect" && relative {
+    var anchorX, anchorY *float64
+    if anchor != nil {
+      anchorX, anchorY = &anchor.X, &anchor.Y
+    }
+
+    left, clipWidth, err := resolveSpan( xValue, widthValue, originalWidth, anchorX, "x offset", "width" )
+    if err != nil {
+      return nil, err
+    }
+    top, clipHeight, err := resolveSpan( yValue, heightValue, originalHeight, anchorY, "y offset", "height" )
+    if err != nil {
+      return nil, err
+    }
+
+    x1, y1, x2, y2 = left, top, left + clipWidth, top + clipHeight
+    if clipWidth <= 0 || clipHeight <= 0 {
+      return nil, fmt.Errorf( "The region ( %d,%d )-( %d,%d ) is empty.", x1, y1, x2, y2 )
+    }
+  }
+
+  var score *float64
+  if mode == "smart" {
+    var width, height int
+    if aspect > 0 {
+      width, height = aspectSize( originalWidth, originalHeight, aspect )
+    } else {
+      width, err = parseLength( widthValue, originalWidth, "width" )
+      if err != nil {
+        return nil, err
+      }
+      height, err = parseLength( heightValue, originalHeight, "height" )
+      if err != nil {
+        return nil, err
+      }
+    }
+
+    if width <= 0 || height <= 0 {
+      return nil, fmt.Errorf( "The smart mode requires a positive width and height ( got %dx%d ).", width, height )
+    }
+
+    if width > originalWidth || height > originalHeight {
+      return nil, fmt.Errorf( "The region size %dx%d exceeds the image size %dx%d.",
+        width, height, originalWidth, originalHeight )
+    }
+
+    region, share := smartCrop( sourceImage, width, height )
+    region = region.Sub( bounds.Min )
+    x1, y1, x2, y2 = region.Min.X, region.Min.Y, region.Max.X, region.Max.Y
+    score = &share
+  }
+
+  // the background only fills the outside of a shape and padding
+  background = opaqueBackground( background, outputExtension, format )
+
+  result, err := writeClip( sourceImage, image.Rect( x1, y1, x2, y2 ), shape, overflow, background, inputPath, outputPath, outputExtension,
+    format, quality )
+  if err != nil {
+    return nil, err
+  }
+
+  result.Mode = mode
+  result.Score = score
+  if score != nil {
+    result.Message += fmt.Sprintf( " ( smart, score %.2f )", *score )
+  }
+  if anchor != nil {
+    result.Gravity = anchor.Name
+  }
+  if aspect > 0 {
+    result.Aspect = strings.TrimSpace( aspectValue )
+  }
+
+  return result, nil
+}
+
+func clipRegionsCommand( context *cli.Context ) error {
+  useJSON := context.Bool( "json" )
+  results, err := clipRegions( context )
+
+  if err != nil {
+    outputError( err.Error(), useJSON )
+    return err
+  }
+
+  if useJSON {
+    outputSuccess( results, useJSON )
+  } else {
+    for _, result := range results {
+      fmt.Println( result.Message )
+      fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+    }
+  }
+
+  return nil
+}
+
+type namedRegion struct {
+  Name                  string
+  Rect                  image.Rectangle
+}
+
+// loadRegions reads named rectangles from a JSON array of objects with name, x1, y1,
+// x2 and y2 ( the form of clip_region ), or from CSV rows of name,x1,y1,x2,y2 with an
+// optional header; files without a .json or .csv extension are recognised by content
+func loadRegions( path string ) ( []namedRegion, error ) {
+  data, err := os.ReadFile( path )
+  if err != nil {
+    return nil, fmt.Errorf( "The regions file %s could not be read: %w", path, err )
+  }
+
+  extension := strings.ToLower( filepath.Ext( path ) )
+  isJSON := extension == ".json" ||
+    ( extension != ".csv" && strings.HasPrefix( strings.TrimSpace( string( data ) ), "[" ) )
+
+  var regions []namedRegion
+  if isJSON {
+    var entries []struct {
+      Name              string `json:"name"`
+      X1                *int   `json:"x1"`
+      Y1                *int   `json:"y1"`
+      X2                *int   `json:"x2"`
+      Y2                *int   `json:"y2"`
+    }
+
+    decoder := json.NewDecoder( bytes.NewReader( data ) )
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode( &entries ); err != nil {
+      return nil, fmt.Errorf( "The regions file %s is not a valid JSON array of regions: %w", path, err )
+    }
+
+    for index, entry := range entries {
+      if entry.X1 == nil || entry.Y1 == nil || entry.X2 == nil || entry.Y2 == nil {
+        return nil, fmt.Errorf( "Region %d in %s is missing one of x1, y1, x2, or y2.", index + 1, path )
+      }
+      // image.Rect would swap reversed corners, which should be reported instead
+      regions = append( regions, namedRegion{ entry.Name, image.Rectangle{
+        image.Pt( *entry.X1, *entry.Y1 ), image.Pt( *entry.X2, *entry.Y2 ) } } )
+    }
+  } else {
+    reader := csv.NewReader( bytes.NewReader( data ) )
+    reader.Comment = '#'
+    reader.TrimLeadingSpace = true
+    reader.FieldsPerRecord = -1
+
+    records, err := reader.ReadAll()
+    if err != nil {
+      return nil, fmt.Errorf( "The regions file %s is not valid CSV: %w", path, err )
+    }
+
+    for index, record := range records {
+      // rows are name,x1,y1,x2,y2, or just the coordinates
+      if len( record ) != 4 && len( record ) != 5 {
+        return nil, fmt.Errorf( "Row %d of %s has %d fields ( expected name, x1, y1, x2, y2 ).", index + 1, path, len( record ) )
+      }
+      fields := record[ len( record ) - 4: ]
+
+      var coordinates [ 4 ]int
+      valid, numeric := true, false
+      for field := range fields {
+        value := strings.TrimSpace( fields[ field ] )
+        coordinates[ field ], err = strconv.Atoi( value )
+        valid = valid && err == nil
+        if _, err := strconv.ParseFloat( value, 64 ); err == nil {
+          numeric = true
+        }
+      }
+      if !valid {
+        // only a first row without any numbers is a header; anything else is a typo
+        if index == 0 && !numeric {
+          continue
+        }
+        return nil, fmt.Errorf( "Row %d of %s has coordinates that are not whole numbers.", index + 1, path )
+      }
+
+      name := ""
+      if len( record ) == 5 {
+        name = strings.TrimSpace( record[ 0 ] )
+      }
+      regions = append( regions, namedRegion{ name, image.Rectangle{
+        image.Pt( coordinates[ 0 ], coordinates[ 1 ] ), image.Pt( coordinates[ 2 ], coordinates[ 3 ] ) } } )
+    }
+  }
+
+  if len( regions ) == 0 {
+    return nil, fmt.Errorf( "The regions file %s does not contain any regions.", path )
+  }
+
+  return regions, nil
+}
+
+// expandTemplate fills the {name} and {index} placeholders of an output file name
+func expandTemplate( template string, name string, index int ) string {
+  return strings.NewReplacer( "{name}", name, "{index}", strconv.Itoa( index ) ).Replace( template )
+}
+
+func clipRegions( context *cli.Context ) ( []*ClipResult, error ) {
+  if context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 2 arguments ( input and output template ), but got %d.", context.NArg() )
+  }
+
+  inputPath := context.Args().Get( 0 )
+  template := context.Args().Get( 1 )
+  regionsPath := context.String( "regions" )
+  quality := context.Int( "quality" )
+  depth := context.Int( "depth" )
+
+  if quality < 0 || quality > 100 {
+    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
+  }
+
+  overflow, background, err := parseOverflow( context.String( "overflow" ), context.String( "background" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  for _, flag := range []string{ "x1", "y1", "x2", "y2", "x", "y", "width", "height", "gravity", "aspect",
+    "ellipse", "polygon" } {
+    if context.IsSet( flag ) {
+      return nil, fmt.Errorf( "The regions option cannot be combined with --%s.", flag )
+    }
+  }
+
+  if mode := strings.ToLower( context.String( "mode" ) ); mode != "rect" {
+    return nil, fmt.Errorf( "The regions option only supports the rect mode, not %s.", mode )
+  }
+
+  regions, err := loadRegions( regionsPath )
+  if err != nil {
+    return nil, err
+  }
+
+  if len( regions ) > 1 && !strings.Contains( template, "{name}" ) && !strings.Contains( template, "{index}" ) {
+    return nil, fmt.Errorf( "The output template %s must contain {name} or {index} to write more than one region.", template )
+  }
+
+  // resolve every output path first so that nothing is written for a bad file
+  outputPaths := make( []string, len( regions ) )
+  seen := map[ string ]int{}
+  for index := range regions {
+    if regions[ index ].Name == "" {
+      regions[ index ].Name = strconv.Itoa( index + 1 )
+    }
+    if strings.ContainsAny( regions[ index ].Name, `/\` ) {
+      return nil, fmt.Errorf( "The region name %s cannot contain path separators.", regions[ index ].Name )
+    }
+
+    outputPaths[ index ] = expandTemplate( template, regions[ index ].Name, index + 1 )
+    if previous, ok := seen[ outputPaths[ index ] ]; ok {
+      return nil, fmt.Errorf( "Regions %d and %d would both be written to %s.", previous + 1, index + 1, outputPaths[ index ] )
+    }
+    seen[ outputPaths[ index ] ] = index
+  }
+
+  outputExtension := strings.ToLower( filepath.Ext( template ) )
+
+  sourceImage, format, _, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
+  if err != nil {
+    return nil, fmt.Errorf(
+      "The image file %s could not be decoded ( possibly corrupt or unsupported format ): %w",
+      inputPath, err )
+  }
+
+  if sourceImage == nil {
+    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
+  }
+
+  if err := validateDepth( depth, outputExtension, format ); err != nil {
+    return nil, err
+  }
+  sourceImage = convertDepth( sourceImage, depth )
+
+  bounds := sourceImage.Bounds()
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
+
+  if originalWidth <= 0 || originalHeight <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
+      inputPath, originalWidth, originalHeight )
+  }
+
+  for _, region := range regions {
+    rect := region.Rect
+    if rect.Empty() {
+      return nil, fmt.Errorf( "The region %s ( %d,%d )-( %d,%d ) is empty.",
+        region.Name, rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y )
+    }
+    if _, err := overflowRegion( rect, originalWidth, originalHeight, overflow ); err != nil {
+      return nil, fmt.Errorf( "The region %s does not fit: %w", region.Name, err )
+    }
+  }
+
+  background = opaqueBackground( background, outputExtension, format )
+  results := make( []*ClipResult, 0, len( regions ) )
+  for index, region := range regions {
+    result, err := writeClip( sourceImage, region.Rect, nil, overflow, background, inputPath, outputPaths[ index ],
+      outputExtension, format, quality )
+    if err != nil {
+      return nil, err
+    }
+    result.Name = region.Name
+    results = append( results, result )
+  }
+
+  return results, nil
+}
+
+// clipShape is an ellipse or polygon in image coordinates that clip extracts instead
+// of a plain rectangle
+type clipShape struct {
+  Name                  string
+  Points                [][ 2 ]float64
+  Ellipse               [ 4 ]float64
+}
+
+// parseShape reads the ellipse ( cx,cy,rx,ry or cx,cy,r ) or polygon ( x,y;x,y;... )
+// options of clip, returning nil when neither is given
+func parseShape( ellipseValue string, polygonValue string ) ( *clipShape, error ) {
+  switch {
+  case ellipseValue != "" && polygonValue != "":
+    return nil, fmt.Errorf( "The ellipse and polygon options cannot be combined." )
+  case ellipseValue != "":
+    numbers, err := parseNumbers( ellipseValue, "ellipse", 3, 4 )
+    if err != nil {
+      return nil, err
+    }
+    radiusX, radiusY := numbers[ 2 ], numbers[ len( numbers ) - 1 ]
+    if radiusX <= 0 || radiusY <= 0 {
+      return nil, fmt.Errorf( "The ellipse %s is not valid (the radii must be greater than zero).", ellipseValue )
+    }
+    return &clipShape{ Name: "ellipse", Ellipse: [ 4 ]float64{ numbers[ 0 ], numbers[ 1 ], radiusX, radiusY } }, nil
+  case polygonValue != "":
+    shape := &clipShape{ Name: "polygon" }
+    for _, point := range strings.Split( strings.Trim( strings.TrimSpace( polygonValue ), ";" ), ";" ) {
+      numbers, err := parseNumbers( point, "polygon point", 2, 2 )
+      if err != nil {
+        return nil, err
+      }
+      shape.Points = append( shape.Points, [ 2 ]float64{ numbers[ 0 ], numbers[ 1 ] } )
+    }
+    if len( shape.Points ) < 3 {
+      return nil, fmt.Errorf( "The polygon %s is not valid (expected at least 3 points such as 0,0;100,0;50,80).", polygonValue )
+    }
+    return shape, nil
+  }
+
+  return nil, nil
+}
+
+// bounds returns the smallest pixel rectangle holding the shape, which must lie within
+// maxDimension pixels of the origin so that its edges convert to whole pixels safely
+func ( shape *clipShape ) bounds() ( image.Rectangle, error ) {
+  minX, minY := math.Inf( 1 ), math.Inf( 1 )
+  maxX, maxY := math.Inf( -1 ), math.Inf( -1 )
+  points := shape.Points
+  if shape.Name == "ellipse" {
+    centerX, centerY, radiusX, radiusY := shape.Ellipse[ 0 ], shape.Ellipse[ 1 ], shape.Ellipse[ 2 ], shape.Ellipse[ 3 ]
+    points = [][ 2 ]float64{ { centerX - radiusX, centerY - radiusY }, { centerX + radiusX, centerY + radiusY } }
+  }
+
+  for _, point := range points {
+    minX, minY = math.Min( minX, point[ 0 ] ), math.Min( minY, point[ 1 ] )
+    maxX, maxY = math.Max( maxX, point[ 0 ] ), math.Max( maxY, point[ 1 ] )
+  }
+
+  if !( minX >= -maxDimension && minY >= -maxDimension && maxX <= maxDimension && maxY <= maxDimension ) {
+    return image.Rectangle{}, fmt.Errorf( "The %s reaches ( %g,%g )-( %g,%g ), beyond the %d pixel limit on either side of the origin.",
+      shape.Name, minX, minY, maxX, maxY, maxDimension )
+  }
+
+  return image.Rect( int( math.Floor( minX ) ), int( math.Floor( minY ) ), int( math.Ceil( maxX ) ), int( math.Ceil( maxY ) ) ), nil
+}
+
+// mask rasterizes the shape with anti-aliased edges into an alpha mask covering the
+// given rectangle of image coordinates
+func ( shape *clipShape ) mask( rect image.Rectangle ) *image.Alpha {
+  rasterizer := vector.NewRasterizer( rect.Dx(), rect.Dy() )
+  point := func( x float64, y float64 ) ( float32, float32 ) {
+    return float32( x - float64( rect.Min.X ) ), float32( y - float64( rect.Min.Y ) )
+  }
+
+  if shape.Name == "ellipse" {
+    // four cubic curves, one per quadrant, with the usual circle approximation
+    const kappa = 0.5522847498
+    centerX, centerY, radiusX, radiusY := shape.Ellipse[ 0 ], shape.Ellipse[ 1 ], shape.Ellipse[ 2 ], shape.Ellipse[ 3 ]
+    curve := func( x1, y1, x2, y2, x3, y3 float64 ) {
+      ax, ay := point( x1, y1 )
+      bx, by := point( x2, y2 )
+      cx, cy := point( x3, y3 )
+      rasterizer.CubeTo( ax, ay, bx, by, cx, cy )
+    }
+
+    rasterizer.MoveTo( point( centerX + radiusX, centerY ) )
+    curve( centerX + radiusX, centerY + kappa * radiusY, centerX + kappa * radiusX, centerY + radiusY, centerX, centerY + radiusY )
+    curve( centerX - kappa * radiusX, centerY + radiusY, centerX - radiusX, centerY + kappa * radiusY, centerX - radiusX, centerY )
+    curve( centerX - radiusX, centerY - kappa * radiusY, centerX - kappa * radiusX, centerY - radiusY, centerX, centerY - radiusY )
+    curve( centerX + kappa * radiusX, centerY - radiusY, centerX + radiusX, centerY - kappa * radiusY, centerX + radiusX, centerY )
+  } else {
+    rasterizer.MoveTo( point( shape.Points[ 0 ][ 0 ], shape.Points[ 0 ][ 1 ] ) )
+    for _, next := range shape.Points[ 1: ] {
+      rasterizer.LineTo( point( next[ 0 ], next[ 1 ] ) )
+    }
+  }
+  rasterizer.ClosePath()
+
+  mask := image.NewAlpha( image.Rect( 0, 0, rect.Dx(), rect.Dy() ) )
+  rasterizer.Draw( mask, mask.Bounds(), image.Opaque, image.Point{} )
+  return mask
+}
+
+// applyShape keeps the part of the image inside the shape, blending it over the
+// background by the shape's coverage; origin is the image position of the top left
+// pixel in image coordinates
+func applyShape( img image.Image, shape *clipShape, origin image.Point, background color.Color ) image.Image {
+  bounds := img.Bounds()
+  mask := shape.mask( bounds.Sub( bounds.Min ).Add( origin ) )
+
+  canvas := newBackgroundCanvas( img, image.Rect( 0, 0, bounds.Dx(), bounds.Dy() ), background )
+  draw.DrawMask( canvas, canvas.Bounds(), img, bounds.Min, mask, image.Point{}, draw.Over )
+  return canvas
+}
+
+// parseOverflow checks the overflow mode of clip and reads the padding background
+func parseOverflow( mode string, backgroundValue string ) ( string, color.NRGBA, error ) {
+  mode = strings.ToLower( strings.TrimSpace( mode ) )
+  if mode != "error" && mode != "clamp" && mode != "pad" {
+    return "", color.NRGBA{}, fmt.Errorf( "The overflow mode %s is not supported ( expected error, clamp, or pad ).", mode )
+  }
+
+  background, err := parseColor( backgroundValue )
+  if err != nil {
+    return "", color.NRGBA{}, err
+  }
+
+  return mode, background, nil
+}
+
+// overflowRegion returns the part of a requested region ( relative to the image origin )
+// that lies inside a width by height image. regions reaching past the edges are an
+// error in the error mode, padded regions are limited to the largest output size, and
+// any mode fails when nothing of the image is left
+func overflowRegion( requested image.Rectangle, width int, height int, overflow string ) ( image.Rectangle, error ) {
+  // the pad mode allocates the whole requested region; floats keep extreme coordinates
+  // from wrapping around
+  if overflow == "pad" && ( float64( requested.Max.X ) - float64( requested.Min.X ) > maxDimension ||
+    float64( requested.Max.Y ) - float64( requested.Min.Y ) > maxDimension ) {
+    return image.Rectangle{}, fmt.Errorf( "The region ( %d,%d )-( %d,%d ) is larger than the maximum of %d pixels on a side.",
+      requested.Min.X, requested.Min.Y, requested.Max.X, requested.Max.Y, maxDimension )
+  }
+
+  if overflow == "error" {
+    if requested.Min.X < 0 || requested.Min.Y < 0 {
+      return image.Rectangle{}, fmt.Errorf( "The region ( %d,%d )-( %d,%d ) starts outside the image.",
+        requested.Min.X, requested.Min.Y, requested.Max.X, requested.Max.Y )
+    }
+
+    if requested.Max.X > width {
+      return image.Rectangle{}, fmt.Errorf( "The x2 coordinate ( %d ) exceeds the image width ( %d ).", requested.Max.X, width )
+    }
+
+    if requested.Max.Y > height {
+      return image.Rectangle{}, fmt.Errorf( "The y2 coordinate ( %d ) exceeds the image height ( %d ).", requested.Max.Y, height )
+    }
+  }
+
+  effective := requested.Intersect( image.Rect( 0, 0, width, height ) )
+  if effective.Empty() {
+    return image.Rectangle{}, fmt.Errorf( "The region ( %d,%d )-( %d,%d ) lies entirely outside the %dx%d image.",
+      requested.Min.X, requested.Min.Y, requested.Max.X, requested.Max.Y, width, height )
+  }
+
+  return effective, nil
+}
+
+// writeClip copies a requested region ( relative to the image origin ) into a new image
+// and writes it to the output path. the part outside the image is left out in the
+// clamp overflow mode, or filled with the background in the pad mode
+func writeClip( sourceImage image.Image, requested image.Rectangle, shape *clipShape, overflow string,
+  background color.Color, inputPath string, outputPath string, outputExtension string, format string,
+  quality int ) ( *ClipResult, error ) {
+  bounds := sourceImage.Bounds()
+  region, err := overflowRegion( requested, bounds.Dx(), bounds.Dy(), overflow )
+  if err != nil {
+    return nil, err
+  }
+
+  // copy the source region into a new image
+  clippedImage := cropImage( sourceImage, region.Add( bounds.Min ) )
+
+  var offset *Point
+  origin := region.Min
+  if overflow == "pad" && region != requested {
+    placement := region.Min.Sub( requested.Min )
+    clippedImage = padImage( clippedImage, requested.Dx(), requested.Dy(), placement, background )
+    offset = &Point{ X: placement.X, Y: placement.Y }
+    origin = requested.Min
+  }
+
+  if shape != nil {
+    clippedImage = applyShape( clippedImage, shape, origin, background )
+  }
+
+  clippedBounds := clippedImage.Bounds()
+  message := fmt.Sprintf( "Clipping %s [%s] region ( %d,%d )-( %d,%d ) -> %dx%d",
+    filepath.Base( inputPath ),
+    format,
+    region.Min.X, region.Min.Y, region.Max.X, region.Max.Y,
+    clippedBounds.Dx(), clippedBounds.Dy(),
+  )
+  if region != requested {
+    adjustment := "clamped"
+    if overflow == "pad" {
+      adjustment = "padded"
+    }
+    message += fmt.Sprintf( " ( %s from ( %d,%d )-( %d,%d ) )", adjustment,
+      requested.Min.X, requested.Min.Y, requested.Max.X, requested.Max.Y )
+  }
+
+  err = encodeOutput( outputPath, outputExtension, clippedImage, quality, format )
+  if err != nil {
+    return nil, fmt.Errorf( "The output file %s could not be written: %w", outputPath, err )
+  }
+
+  result := &ClipResult{
+    InputFile:       inputPath,
+    OutputFile:      outputPath,
+    Format:          format,
+    OriginalSize:    Size{ Width: bounds.Dx(), Height: bounds.Dy() },
+    Mode:            "rect",
+    Overflow:        overflow,
+    PlacementOffset: offset,
+    ClipRegion:      Region{ X1: region.Min.X, Y1: region.Min.Y, X2: region.Max.X, Y2: region.Max.Y },
+    ClipSize:        Size{ Width: clippedBounds.Dx(), Height: clippedBounds.Dy() },
+    ColorModel:      colorModelName( clippedImage ),
+    Message:         message,
+  }
+  if shape != nil {
+    result.Shape = shape.Name
+  }
+  if region != requested {
+    result.RequestedRegion = &Region{ X1: requested.Min.X, Y1: requested.Min.Y, X2: requested.Max.X, Y2: requested.Max.Y }
+  }
+
+  return result, nil
+}
+
+func trimImageCommand( context *cli.Context ) error {
+  useJSON := context.Bool( "json" )
+  result, err := trimImage( context )
+
+  if err != nil {
+    outputError( err.Error(), useJSON )
+    return err
+  }
+
+  if useJSON {
+    outputSuccess( result, useJSON )
+  } else {
+    fmt.Println( result.Message )
+    if result.OutputFile != "" {
+      fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+    }
+  }
+
+  return nil
+}
+
+func trimImage( context *cli.Context ) ( *TrimResult, error ) {
+  if context.NArg() != 1 && context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 1 or 2 arguments ( input and optional output ), but got %d.", context.NArg() )
+  }
+
+  inputPath := context.Args().Get( 0 )
+  outputPath := context.Args().Get( 1 )
+  quality := context.Int( "quality" )
+
+  if quality < 0 || quality > 100 {
+    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
+  }
+
+  fuzz, err := parseFuzz( context.String( "fuzz" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  sourceImage, format, _, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
+  if err != nil {
+    return nil, fmt.Errorf(
+      "The image file %s could not be decoded ( possibly corrupt or unsupported format ): %w",
+      inputPath, err )
+  }
+
+  if sourceImage == nil {
+    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
+  }
+
+  bounds := sourceImage.Bounds()
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
+
+  if originalWidth <= 0 || originalHeight <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
+      inputPath, originalWidth, originalHeight )
+  }
+
+  background := detectBackground( sourceImage, fuzz )
+  content := trimBounds( sourceImage, background, fuzz )
+  if content.Empty() {
+    return nil, fmt.Errorf( "The image %s only contains the background color %s.", inputPath, formatColor( background ) )
+  }
+
+  region := content.Sub( bounds.Min )
+  message := fmt.Sprintf( "Trimming %s [%s] from %dx%d to %dx%d, content ( %d,%d )-( %d,%d ) on background %s",
+    filepath.Base( inputPath ),
+    format,
+    originalWidth, originalHeight,
+    region.Dx(), region.Dy(),
+    region.Min.X, region.Min.Y, region.Max.X, region.Max.Y,
+    formatColor( background ),
+  )
+
+  if outputPath != "" {
+    outputExtension := strings.ToLower( filepath.Ext( outputPath ) )
+    err = encodeOutput( outputPath, outputExtension, cropImage( sourceImage, content ), quality, format )
+    if err != nil {
+      return nil, fmt.Errorf( "The output file %s could not be written: %w", outputPath, err )
+    }
+  }
+
+  return &TrimResult{
+    InputFile:    inputPath,
+    OutputFile:   outputPath,
+    Format:       format,
+    OriginalSize: Size{ Width: originalWidth, Height: originalHeight },
+    Background:   formatColor( background ),
+    Fuzz:         fuzz,
+    BoundingBox:  Region{ X1: region.Min.X, Y1: region.Min.Y, X2: region.Max.X, Y2: region.Max.Y },
+    TrimmedSize:  Size{ Width: region.Dx(), Height: region.Dy() },
+    Message:      message,
+  }, nil
+}
+
+func deskewImageCommand( context *cli.Context ) error {
+  useJSON := context.Bool( "json" )
+  result, err := deskewImage( context )
+
+  if err != nil {
+    outputError( err.Error(), useJSON )
+    return err
+  }
+
+  if useJSON {
+    outputSuccess( result, useJSON )
+  } else {
+    fmt.Println( result.Message )
+    fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+  }
+
+  return nil
+}
+
+func deskewImage( context *cli.Context ) ( *DeskewResult, error ) {
+  if context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 2 arguments ( input and output ), but got %d.", context.NArg() )
+  }
+
+  inputPath := context.Args().Get( 0 )
+  outputPath := context.Args().Get( 1 )
+  maxAngle := context.Float64( "max-angle" )
+  expand := context.Bool( "expand" )
+  quality := context.Int( "quality" )
+  backgroundName := strings.ToLower( strings.TrimSpace( context.String( "background" ) ) )
+
+  if quality < 0 || quality > 100 {
+    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
+  }
+
+  if math.IsNaN( maxAngle ) || maxAngle <= 0 || maxAngle > 45 {
+    return nil, fmt.Errorf( "The maximum angle must be greater than 0 and at most 45 degrees, but got %g.", maxAngle )
+  }
+
+  filter, filterName, err := parseFilter( context.String( "filter" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  var background color.Color
+  if backgroundName != "auto" {
+    background, err = parseColor( backgroundName )
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  outputExtension := strings.ToLower( filepath.Ext( outputPath ) )
+
+  sourceImage, format, _, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
+  if err != nil {
+    return nil, fmt.Errorf(
+      "The image file %s could not be decoded ( possibly corrupt or unsupported format ): %w",
+      inputPath, err )
+  }
+
+  if sourceImage == nil {
+    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
+  }
+
+  bounds := sourceImage.Bounds()
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
+
+  if originalWidth <= 0 || originalHeight <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
+      inputPath, originalWidth, originalHeight )
+  }
+
+  if background == nil {
+    // the corners of a scan are almost always bare paper
+    background = detectBackground( sourceImage, 10 )
+  }
+
+  skew := detectSkew( sourceImage, maxAngle )
+  rotation := 0.0
+  deskewedImage := sourceImage
+  if skew != 0 {
+    rotation = -skew
+    deskewedImage = rotateAnyAngle( sourceImage, rotation, expand, background, filter )
+  }
+
+  finalBounds := deskewedImage.Bounds()
+  message := fmt.Sprintf( "Deskewing %s [%s] %dx%d, detected skew %.2f°, rotated by %.2f° -> %dx%d",
+    filepath.Base( inputPath ),
+    format,
+    originalWidth, originalHeight,
+    skew, rotation,
+    finalBounds.Dx(), finalBounds.Dy(),
+  )
+
+  err = encodeOutput( outputPath, outputExtension, deskewedImage, quality, format )
+  if err != nil {
+    return nil, fmt.Errorf( "The output file %s could not be written: %w", outputPath, err )
+  }
+
+  return &DeskewResult{
+    InputFile:    inputPath,
+    OutputFile:   outputPath,
+    Format:       format,
+    OriginalSize: Size{ Width: originalWidth, Height: originalHeight },
+    FinalSize:    Size{ Width: finalBounds.Dx(), Height: finalBounds.Dy() },
+    SkewAngle:    skew,
+    Rotation:     rotation,
+    Background:   formatColor( background ),
+    Filter:       filterName,
+    ColorModel:   colorModelName( deskewedImage ),
+    Message:      message,
+  }, nil
+}
+
+func perspectiveImageCommand( context *cli.Context ) error {
+  useJSON := context.Bool( "json" )
+  result, err := perspectiveImage( context )
+
+  if err != nil {
+    outputError( err.Error(), useJSON )
+    return err
+  }
+
+  if useJSON {
+    outputSuccess( result, useJSON )
+  } else {
+    fmt.Println( result.Message )
+    fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+  }
+
+  return nil
+}
+
+func perspectiveImage( context *cli.Context ) ( *PerspectiveResult, error ) {
+  if context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 2 arguments ( input and output ), but got %d.", context.NArg() )
+  }
+
+  inputPath := context.Args().Get( 0 )
+  outputPath := context.Args().Get( 1 )
+  width := context.Int( "width" )
+  height := context.Int( "height" )
+  quality := context.Int( "quality" )
+
+  if quality < 0 || quality > 100 {
+    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
+  }
+
+  if width < 0 || height < 0 || width > maxDimension || height > maxDimension {
+    return nil, fmt.Errorf( "The output size must be between 1 and %d pixels, but got %dx%d.", maxDimension, width, height )
+  }
+
+  var corners [ 4 ][ 2 ]float64
+  for index := range corners {
+    for axis, name := range []string{ "x", "y" } {
+      flag := fmt.Sprintf( "%s%d", name, index + 1 )
+      if !context.IsSet( flag ) {
+        return nil, fmt.Errorf( "All four corners are required, but --%s is missing.", flag )
+      }
+      value := context.Float64( flag )
+      if math.IsNaN( value ) || math.IsInf( value, 0 ) {
+        return nil, fmt.Errorf( "The %s coordinate ( %g ) is not a valid number.", flag, value )
+      }
+      corners[ index ][ axis ] = value
+    }
+  }
+
+  if !isConvexQuad( corners ) {
+    return nil, fmt.Errorf( "The corners do not form a convex quadrilateral " +
+      "( expected top left, top right, bottom right, and bottom left in order )." )
+  }
+
+  _, filterName, err := parseFilter( context.String( "filter" ) )
+  if err != nil {
+    return nil, err
+  }
+  if filterName != "nearest" && filterName != "bilinear" && filterName != "catmull-rom" {
+    return nil, fmt.Errorf(
+      "The filter %s is not supported for perspective correction ( expected nearest, bilinear, or catmull-rom ).",
+      filterName )
+  }
+
+  background, err := parseColor( context.String( "background" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  threads := context.Int( "threads" )
+  if threads < 0 {
+    return nil, fmt.Errorf( "Threads cannot be negative, but got %d.", threads )
+  }
+  if threads == 0 {
+    threads = runtime.GOMAXPROCS( 0 )
+  }
+
+  // a missing side follows the aspect ratio of the quadrilateral
+  inferred := width == 0 || height == 0
+  if inferred {
+    quadWidth, quadHeight := quadSize( corners )
+    switch {
+    case width == 0 && height == 0:
+      width, height = quadWidth, quadHeight
+    case width == 0:
+      width = max( int( math.Round( float64( height ) * float64( quadWidth ) / float64( quadHeight ) ) ), 1 )
+    default:
+      height = max( int( math.Round( float64( width ) * float64( quadHeight ) / float64( quadWidth ) ) ), 1 )
+    }
+
+    if width > maxDimension || height > maxDimension {
+      return nil, fmt.Errorf( "The inferred output size %dx%d exceeds the maximum of %d pixels.", width, height, maxDimension )
+    }
+  }
+
+  outputExtension := strings.ToLower( filepath.Ext( outputPath ) )
+
+  sourceImage, format, _, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
+  if err != nil {
+    return nil, fmt.Errorf(
+      "The image file %s could not be decoded ( possibly corrupt or unsupported format ): %w",
+      inputPath, err )
+  }
+
+  if sourceImage == nil {
+    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
+  }
+
+  bounds := sourceImage.Bounds()
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
+
+  if originalWidth <= 0 || originalHeight <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
+      inputPath, originalWidth, originalHeight )
+  }
+
+  warpedImage := warpPerspective( sourceImage, corners, width, height, filterName, background, threads )
+
+  message := fmt.Sprintf( "Rectifying %s [%s] quadrilateral ( %g,%g ) ( %g,%g ) ( %g,%g ) ( %g,%g ) -> %dx%d",
+    filepath.Base( inputPath ),
+    format,
+    corners[ 0 ][ 0 ], corners[ 0 ][ 1 ], corners[ 1 ][ 0 ], corners[ 1 ][ 1 ],
+    corners[ 2 ][ 0 ], corners[ 2 ][ 1 ], corners[ 3 ][ 0 ], corners[ 3 ][ 1 ],
+    width, height,
+  )
+
+  err = encodeOutput( outputPath, outputExtension, warpedImage, quality, format )
+  if err != nil {
+    return nil, fmt.Errorf( "The output file %s could not be written: %w", outputPath, err )
+  }
+
+  result := &PerspectiveResult{
+    InputFile:    inputPath,
+    OutputFile:   outputPath,
+    Format:       format,
+    OriginalSize: Size{ Width: originalWidth, Height: originalHeight },
+    FinalSize:    Size{ Width: width, Height: height },
+    SizeInferred: inferred,
+    Filter:       filterName,
+    ColorModel:   colorModelName( warpedImage ),
+    Message:      message,
+  }
+  for _, corner := range corners {
+    result.Corners = append( result.Corners, Corner{ X: corner[ 0 ], Y: corner[ 1 ] } )
+  }
+
+  return result, nil
+}
+
+func affineImageCommand( context *cli.Context ) error {
+  useJSON := context.Bool( "json" )
+  result, err := affineTransformImage( context )
+
+  if err != nil {
+    outputError( err.Error(), useJSON )
+    return err
+  }
+
+  if useJSON {
+    outputSuccess( result, useJSON )
+  } else {
+    fmt.Println( result.Message )
+    fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+  }
+
+  return nil
+}
+
+func affineTransformImage( context *cli.Context ) ( *AffineResult, error ) {
+  if context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 2 arguments ( input and output ), but got %d.", context.NArg() )
+  }
+
+  inputPath := context.Args().Get( 0 )
+  outputPath := context.Args().Get( 1 )
+  width := context.Int( "width" )
+  height := context.Int( "height" )
+  expand := context.Bool( "expand" )
+  quality := context.Int( "quality" )
+
+  if quality < 0 || quality > 100 {
+    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
+  }
+
+  if width < 0 || height < 0 || width > maxDimension || height > maxDimension {
+    return nil, fmt.Errorf( "The output size must be between 1 and %d pixels, but got %dx%d.", maxDimension, width, height )
+  }
+
+  if expand && ( width != 0 || height != 0 ) {
+    return nil, fmt.Errorf( "The expand option cannot be combined with width or height." )
+  }
+
+  matrix, err := parseAffine( context.String( "matrix" ), context.String( "translate" ),
+    context.String( "scale" ), context.String( "shear" ), context.Float64( "rotate" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  // the inverse is needed to sample the source, so the matrix must not collapse an axis
+  if determinant := matrix[ 0 ] * matrix[ 4 ] - matrix[ 1 ] * matrix[ 3 ]; math.Abs( determinant ) < 1e-9 {
+    return nil, fmt.Errorf( "The transform is not invertible ( it collapses the image onto a line or point )." )
+  }
+
+  filter, filterName, err := parseFilter( context.String( "filter" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  background, err := parseColor( context.String( "background" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  outputExtension := strings.ToLower( filepath.Ext( outputPath ) )
+
+  sourceImage, format, _, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
+  if err != nil {
+    return nil, fmt.Errorf(
+      "The image file %s could not be decoded ( possibly corrupt or unsupported format ): %w",
+      inputPath, err )
+  }
+
+  if sourceImage == nil {
+    return nil, fmt.Errorf( "The decoded image from %s is invalid.", inputPath )
+  }
+
+  bounds := sourceImage.Bounds()
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
+
+  if originalWidth <= 0 || originalHeight <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
+      inputPath, originalWidth, originalHeight )
+  }
 
-      destinationImage = resizedImage
-      resized = true
+  if expand {
+    // the small epsilon keeps exact sizes from rounding up a pixel
+    minX, minY, maxX, maxY := affineBounds( matrix, originalWidth, originalHeight )
+    width = int( math.Ceil( maxX - minX - 1e-9 ) )
+    height = int( math.Ceil( maxY - minY - 1e-9 ) )
+    matrix[ 2 ] -= minX
+    matrix[ 5 ] -= minY
+  } else {
+    if width == 0 {
+      width = originalWidth
+    }
+    if height == 0 {
+      height = originalHeight
     }
   }
 
-  outputExtension := strings.ToLower( filepath.Ext( outputPath ) )
-  err = encodeOutput( outputPath, outputExtension, destinationImage, quality, format )
+  if width < 1 || height < 1 || width > maxDimension || height > maxDimension {
+    return nil, fmt.Errorf( "The output size %dx%d is outside the supported range of 1 to %d pixels.",
+      width, height, maxDimension )
+  }
+
+  transformedImage := affineImage( sourceImage, matrix, width, height, background, filter )
+
+  message := fmt.Sprintf( "Transforming %s [%s] %dx%d with matrix [ %.6g %.6g %.6g; %.6g %.6g %.6g ] -> %dx%d",
+    filepath.Base( inputPath ),
+    format,
+    originalWidth, originalHeight,
+    matrix[ 0 ], matrix[ 1 ], matrix[ 2 ], matrix[ 3 ], matrix[ 4 ], matrix[ 5 ],
+    width, height,
+  )
+
+  err = encodeOutput( outputPath, outputExtension, transformedImage, quality, format )
   if err != nil {
     return nil, fmt.Errorf( "The output file %s could not be written: %w", outputPath, err )
   }
 
-  return &TransformResult{
-    InputFile:  inputPath,
-    OutputFile: outputPath,
-    Format:     format,
-    OriginalSize: Size{
-      Width:  originalWidth,
-      Height: originalHeight,
-    },
-    FinalSize: Size{
-      Width:  targetWidth,
-      Height: targetHeight,
-    },
-    Resized: resized,
-    Message: message,
+  return &AffineResult{
+    InputFile:    inputPath,
+    OutputFile:   outputPath,
+    Format:       format,
+    OriginalSize: Size{ Width: originalWidth, Height: originalHeight },
+    FinalSize:    Size{ Width: width, Height: height },
+    Matrix:       matrix,
+    Filter:       filterName,
+    ColorModel:   colorModelName( transformedImage ),
+    Message:      message,
   }, nil
 }
 
-func imageInfoCommand( context *cli.Context ) error {
+func tileImageCommand( context *cli.Context ) error {
   useJSON := context.Bool( "json" )
-  result, err := imageInfo( context )
+  result, err := tileImage( context )
 
   if err != nil {
     outputError( err.Error(), useJSON )
@@ -504,40 +5126,135 @@ func imageInfoCommand( context *cli.Context ) error {
   if useJSON {
     outputSuccess( result, useJSON )
   } else {
-    fmt.Printf( "File:         %s\n", result.File )
-    fmt.Printf( "Path:         %s\n", result.Path )
-    fmt.Printf( "Format:       %s\n", strings.ToUpper( result.Format ) )
-    fmt.Printf( "Dimensions:   %d × %d pixels\n", result.Width, result.Height )
-    fmt.Printf( "Aspect Ratio: %.2f:1\n", result.AspectRatio )
-    fmt.Printf( "Transparency: %v\n", result.HasAlpha )
-    fmt.Printf( "Color Model:  %s\n", result.ColorModel )
-    fmt.Printf( "File Size:    %d bytes (%.2f KB)\n", result.FileSize, result.FileSizeKB )
+    fmt.Println( result.Message )
+    for _, tile := range result.Tiles {
+      fmt.Printf( "✓ Saved to %s\n", tile.OutputFile )
+    }
   }
 
   return nil
 }
 
-func imageInfo( context *cli.Context ) ( *InfoResult, error ) {
-  if context.NArg() != 1 {
-    return nil, fmt.Errorf( "Expected 1 argument (input file), but got %d.", context.NArg() )
+// the most tiles a single call may write, to catch sizes given in the wrong unit
+const maxTiles = 10000
+
+type tileSpan struct {
+  Start                 int
+  End                   int
+}
+
+// tileSpans splits a length into tiles of the given size, each sharing overlap pixels
+// with the next, for as many tiles as it takes to cover the length; the last tile is
+// cut short when it runs past the end
+func tileSpans( total int, size int, overlap int ) []tileSpan {
+  stride := size - overlap
+  count := max( ( total - overlap + stride - 1 ) / stride, 1 )
+
+  spans := make( []tileSpan, count )
+  for index := range spans {
+    start := index * stride
+    spans[ index ] = tileSpan{ start, min( start + size, total ) }
+  }
+  return spans
+}
+
+// gridSpans splits a length into count tiles that cover it exactly, each sharing
+// overlap pixels with the next; the remainder goes to the first tiles, so sizes differ
+// by at most one pixel and the largest tile comes first
+func gridSpans( total int, count int, overlap int ) []tileSpan {
+  covered := total + ( count - 1 ) * overlap
+  spans := make( []tileSpan, count )
+  start := 0
+  for index := range spans {
+    size := covered / count
+    if index < covered % count {
+      size++
+    }
+    spans[ index ] = tileSpan{ start, start + size }
+    start += size - overlap
+  }
+  return spans
+}
+
+// fixedTileSize checks the requested tile size against the largest output, since
+// padded tiles are allocated whole, then lets a missing side span the image
+func fixedTileSize( width int, height int, imageWidth int, imageHeight int ) ( int, int, error ) {
+  if width > maxDimension {
+    return 0, 0, fmt.Errorf( "The tile width ( %d ) exceeds the maximum of %d pixels.", width, maxDimension )
+  }
+  if height > maxDimension {
+    return 0, 0, fmt.Errorf( "The tile height ( %d ) exceeds the maximum of %d pixels.", height, maxDimension )
+  }
+
+  if width == 0 {
+    width = imageWidth
+  }
+  if height == 0 {
+    height = imageHeight
+  }
+  return width, height, nil
+}
+
+// expandTileTemplate fills the {row} and {col} placeholders, zero-padding them to the
+// same width so that the files sort in order
+func expandTileTemplate( template string, row int, column int, rows int, columns int ) string {
+  rowWidth := len( strconv.Itoa( rows - 1 ) )
+  columnWidth := len( strconv.Itoa( columns - 1 ) )
+  return strings.NewReplacer(
+    "{row}", fmt.Sprintf( "%0*d", rowWidth, row ),
+    "{col}", fmt.Sprintf( "%0*d", columnWidth, column ),
+  ).Replace( template )
+}
+
+func tileImage( context *cli.Context ) ( *TileResult, error ) {
+  if context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 2 arguments ( input and output template ), but got %d.", context.NArg() )
   }
 
   inputPath := context.Args().Get( 0 )
+  template := context.Args().Get( 1 )
+  rows := context.Int( "rows" )
+  columns := context.Int( "columns" )
+  tileWidth := context.Int( "width" )
+  tileHeight := context.Int( "height" )
+  overlap := context.Int( "overlap" )
+  edge := strings.ToLower( strings.TrimSpace( context.String( "edge" ) ) )
+  quality := context.Int( "quality" )
 
-  fileInfo, err := os.Stat( inputPath )
-  if err != nil {
-    return nil, fmt.Errorf( "The file %s could not be accessed: %w", inputPath, err )
+  if quality < 0 || quality > 100 {
+    return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
   }
 
-  if fileInfo.Size() == 0 {
-    return nil, fmt.Errorf( "The file %s is empty.", inputPath )
+  grid := rows != 0 || columns != 0
+  fixed := tileWidth != 0 || tileHeight != 0
+  if grid == fixed {
+    return nil, fmt.Errorf( "Expected either rows and columns ( a grid ) or a tile width and height ( fixed-size tiles )." )
+  }
+
+  if rows < 0 || columns < 0 || tileWidth < 0 || tileHeight < 0 {
+    return nil, fmt.Errorf( "Rows, columns, and tile sizes cannot be negative." )
+  }
+
+  if overlap < 0 {
+    return nil, fmt.Errorf( "The overlap cannot be negative, but got %d.", overlap )
+  }
+
+  if edge != "partial" && edge != "pad" && edge != "drop" {
+    return nil, fmt.Errorf( "The edge mode %s is not supported ( expected partial, pad, or drop ).", edge )
   }
 
-  sourceImage, format, err := loadImage( inputPath )
+  background, err := parseColor( context.String( "background" ) )
   if err != nil {
-    return nil, fmt.Errorf( "The image file %s could not be decoded (possibly corrupt or unsupported format): %w",
-      inputPath,
-      err )
+    return nil, err
+  }
+
+  outputExtension := strings.ToLower( filepath.Ext( template ) )
+
+  sourceImage, format, _, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
+  if err != nil {
+    return nil, fmt.Errorf(
+      "The image file %s could not be decoded ( possibly corrupt or unsupported format ): %w",
+      inputPath, err )
   }
 
   if sourceImage == nil {
@@ -545,41 +5262,138 @@ func imageInfo( context *cli.Context ) ( *InfoResult, error ) {
   }
 
   bounds := sourceImage.Bounds()
-  width := bounds.Dx()
-  height := bounds.Dy()
+  originalWidth := bounds.Dx()
+  originalHeight := bounds.Dy()
 
-  if width <= 0 || height <= 0 {
-    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.", inputPath, width, height )
+  if originalWidth <= 0 || originalHeight <= 0 {
+    return nil, fmt.Errorf( "The image %s has invalid dimensions: %dx%d.",
+      inputPath, originalWidth, originalHeight )
   }
 
-  hasAlpha := false
-  switch sourceImage.( type ) {
-  case *image.NRGBA, *image.NRGBA64, *image.RGBA, *image.RGBA64, *image.Alpha, *image.Alpha16:
-    hasAlpha = true
+  background = opaqueBackground( background, outputExtension, format )
+
+  var columnSpans, rowSpans []tileSpan
+  if grid {
+    if context.IsSet( "edge" ) {
+      return nil, fmt.Errorf( "The edge option only applies to fixed-size tiles, since grid tiles always cover the image exactly." )
+    }
+
+    // a grid given along one axis keeps the other axis whole
+    rows, columns = max( rows, 1 ), max( columns, 1 )
+    if columns > originalWidth || rows > originalHeight {
+      return nil, fmt.Errorf( "A grid of %d rows and %d columns does not fit the %dx%d image.",
+        rows, columns, originalWidth, originalHeight )
+    }
+    columnSpans = gridSpans( originalWidth, columns, overlap )
+    rowSpans = gridSpans( originalHeight, rows, overlap )
+    // the first tile is the largest and the last the smallest
+    tileWidth = columnSpans[ 0 ].End - columnSpans[ 0 ].Start
+    tileHeight = rowSpans[ 0 ].End - rowSpans[ 0 ].Start
+    smallestWidth := columnSpans[ columns - 1 ].End - columnSpans[ columns - 1 ].Start
+    smallestHeight := rowSpans[ rows - 1 ].End - rowSpans[ rows - 1 ].Start
+    if tileWidth > originalWidth || tileHeight > originalHeight ||
+      ( columns > 1 && overlap >= smallestWidth ) || ( rows > 1 && overlap >= smallestHeight ) {
+      return nil, fmt.Errorf( "The overlap ( %d ) is too large for a grid of %d rows and %d columns on the %dx%d image.",
+        overlap, rows, columns, originalWidth, originalHeight )
+    }
+  } else {
+    tileWidth, tileHeight, err = fixedTileSize( tileWidth, tileHeight, originalWidth, originalHeight )
+    if err != nil {
+      return nil, err
+    }
   }
 
-  colorModelName := fmt.Sprintf( "%T", sourceImage )
-  colorModelName = strings.TrimPrefix( colorModelName, "*image." )
+  if ( columns != 1 && overlap >= tileWidth ) || ( rows != 1 && overlap >= tileHeight ) {
+    return nil, fmt.Errorf( "The overlap ( %d ) must be smaller than the tile size ( %dx%d ).", overlap, tileWidth, tileHeight )
+  }
 
-  aspectRatio := float64( width ) / float64( height )
+  if !grid {
+    columnSpans = tileSpans( originalWidth, tileWidth, overlap )
+    rowSpans = tileSpans( originalHeight, tileHeight, overlap )
+  }
 
-  return &InfoResult{
-    File:        filepath.Base( inputPath ),
-    Path:        inputPath,
-    Format:      format,
-    Width:       width,
-    Height:      height,
-    AspectRatio: aspectRatio,
-    HasAlpha:    hasAlpha,
-    ColorModel:  colorModelName,
-    FileSize:    fileInfo.Size(),
-    FileSizeKB:  float64( fileInfo.Size() ) / 1024.0,
-  }, nil
+  if edge == "drop" {
+    full := func( spans []tileSpan, size int ) []tileSpan {
+      kept := spans[ :0 ]
+      for _, span := range spans {
+        if span.End - span.Start == size {
+          kept = append( kept, span )
+        }
+      }
+      return kept
+    }
+    columnSpans = full( columnSpans, tileWidth )
+    rowSpans = full( rowSpans, tileHeight )
+    if len( columnSpans ) == 0 || len( rowSpans ) == 0 {
+      return nil, fmt.Errorf( "No whole %dx%d tile fits the %dx%d image.", tileWidth, tileHeight, originalWidth, originalHeight )
+    }
+  }
+
+  count := len( rowSpans ) * len( columnSpans )
+  if count > maxTiles {
+    return nil, fmt.Errorf( "The image would be split into %d tiles, more than the limit of %d.", count, maxTiles )
+  }
+
+  if count > 1 && ( ( len( rowSpans ) > 1 && !strings.Contains( template, "{row}" ) ) ||
+    ( len( columnSpans ) > 1 && !strings.Contains( template, "{col}" ) ) ) {
+    return nil, fmt.Errorf( "The output template %s must contain {row} and {col} to tell the tiles apart.", template )
+  }
+
+  result := &TileResult{
+    InputFile:    inputPath,
+    Format:       format,
+    OriginalSize: Size{ Width: originalWidth, Height: originalHeight },
+    TileSize:     Size{ Width: tileWidth, Height: tileHeight },
+    Overlap:      overlap,
+    Edge:         edge,
+    Rows:         len( rowSpans ),
+    Columns:      len( columnSpans ),
+    Tiles:        make( []Tile, 0, count ),
+  }
+
+  for row, rowSpan := range rowSpans {
+    for column, columnSpan := range columnSpans {
+      region := image.Rect( columnSpan.Start, rowSpan.Start, columnSpan.End, rowSpan.End )
+      tile := cropImage( sourceImage, region.Add( bounds.Min ) )
+
+      padded := edge == "pad" && ( region.Dx() < tileWidth || region.Dy() < tileHeight )
+      if padded {
+        tile = padImage( tile, tileWidth, tileHeight, image.Point{}, background )
+      }
+
+      outputPath := expandTileTemplate( template, row, column, len( rowSpans ), len( columnSpans ) )
+      err = encodeOutput( outputPath, outputExtension, tile, quality, format )
+      if err != nil {
+        return nil, fmt.Errorf( "The output file %s could not be written: %w", outputPath, err )
+      }
+
+      tileBounds := tile.Bounds()
+      result.Tiles = append( result.Tiles, Tile{
+        Row:        row,
+        Column:     column,
+        OutputFile: outputPath,
+        Region:     Region{ X1: region.Min.X, Y1: region.Min.Y, X2: region.Max.X, Y2: region.Max.Y },
+        Size:       Size{ Width: tileBounds.Dx(), Height: tileBounds.Dy() },
+        Padded:     padded,
+      } )
+    }
+  }
+
+  result.Message = fmt.Sprintf( "Tiling %s [%s] %dx%d into %d rows and %d columns of %dx%d ( overlap %d, %s edges )",
+    filepath.Base( inputPath ),
+    format,
+    originalWidth, originalHeight,
+    result.Rows, result.Columns,
+    tileWidth, tileHeight,
+    overlap, edge,
+  )
+
+  return result, nil
 }
 
-func clipImageCommand( context *cli.Context ) error {
+func spritesImageCommand( context *cli.Context ) error {
   useJSON := context.Bool( "json" )
-  result, err := clipImage( context )
+  result, err := extractSprites( context )
 
   if err != nil {
     outputError( err.Error(), useJSON )
@@ -590,42 +5404,145 @@ func clipImageCommand( context *cli.Context ) error {
     outputSuccess( result, useJSON )
   } else {
     fmt.Println( result.Message )
-    fmt.Printf( "✓ Saved to %s\n", result.OutputFile )
+    for _, sprite := range result.Sprites {
+      box := sprite.BoundingBox
+      fmt.Printf( "Sprite %d ( %d,%d )-( %d,%d ) %dx%d\n", sprite.Index, box.X1, box.Y1, box.X2, box.Y2,
+        box.X2 - box.X1, box.Y2 - box.Y1 )
+      if sprite.OutputFile != "" {
+        fmt.Printf( "✓ Saved to %s\n", sprite.OutputFile )
+      }
+    }
   }
 
   return nil
 }
 
-func clipImage( context *cli.Context ) ( *ClipResult, error ) {
-  if context.NArg() != 2 {
-    return nil, fmt.Errorf( "Expected 2 arguments ( input and output ), but got %d.", context.NArg() )
+// the most sprites a single call may report, to catch noisy images and a fuzz too small
+// to absorb their background
+const maxSprites = 10000
+
+type spriteComponent struct {
+  Label                 int32
+  Rect                  image.Rectangle
+  Area                  int
+}
+
+// findSprites returns the connected regions of pixels that differ from the background
+// by more than the fuzz, relative to the image origin and ordered by their first pixel
+// scanning row by row, along with the label of every pixel ( 0 for the background )
+func findSprites( img image.Image, background color.RGBA64, fuzz float64, connectivity int ) ( []spriteComponent, []int32 ) {
+  bounds := img.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+
+  // -1 marks foreground not yet reached, labels count from 1
+  labels := make( []int32, width * height )
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      if !colorsWithin( rgba64At( img, bounds.Min.X + x, bounds.Min.Y + y ), background, fuzz ) {
+        labels[ y * width + x ] = -1
+      }
+    }
+  }
+
+  neighbours := [][ 2 ]int{ { -1, 0 }, { 1, 0 }, { 0, -1 }, { 0, 1 } }
+  if connectivity == 8 {
+    neighbours = append( neighbours, [ 2 ]int{ -1, -1 }, [ 2 ]int{ 1, -1 }, [ 2 ]int{ -1, 1 }, [ 2 ]int{ 1, 1 } )
+  }
+
+  var components []spriteComponent
+  var stack []int
+  for start := range labels {
+    if labels[ start ] != -1 {
+      continue
+    }
+
+    label := int32( len( components ) + 1 )
+    labels[ start ] = label
+    stack = append( stack[ :0 ], start )
+    left, top, right, bottom := width, height, 0, 0
+    area := 0
+    for len( stack ) > 0 {
+      index := stack[ len( stack ) - 1 ]
+      stack = stack[ :len( stack ) - 1 ]
+      x, y := index % width, index / width
+      left, top, right, bottom = min( left, x ), min( top, y ), max( right, x + 1 ), max( bottom, y + 1 )
+      area++
+
+      for _, offset := range neighbours {
+        nx, ny := x + offset[ 0 ], y + offset[ 1 ]
+        if nx < 0 || ny < 0 || nx >= width || ny >= height || labels[ ny * width + nx ] != -1 {
+          continue
+        }
+        labels[ ny * width + nx ] = label
+        stack = append( stack, ny * width + nx )
+      }
+    }
+
+    components = append( components, spriteComponent{ label, image.Rect( left, top, right, bottom ), area } )
+  }
+
+  return components, labels
+}
+
+// isolateSprite copies the region around a sprite and paints the pixels of every other
+// sprite reaching into it with the background, so that each file holds one sprite
+func isolateSprite( img image.Image, labels []int32, label int32, region image.Rectangle, background color.Color ) image.Image {
+  bounds := img.Bounds()
+  isolated := cropImage( img, region.Add( bounds.Min ) ).( draw.Image )
+  for y := region.Min.Y; y < region.Max.Y; y++ {
+    for x := region.Min.X; x < region.Max.X; x++ {
+      if other := labels[ y * bounds.Dx() + x ]; other != 0 && other != label {
+        isolated.Set( x - region.Min.X, y - region.Min.Y, background )
+      }
+    }
+  }
+  return isolated
+}
+
+func extractSprites( context *cli.Context ) ( *SpritesResult, error ) {
+  if context.NArg() != 1 && context.NArg() != 2 {
+    return nil, fmt.Errorf( "Expected 1 or 2 arguments ( input and optional output template ), but got %d.", context.NArg() )
   }
 
   inputPath := context.Args().Get( 0 )
-  outputPath := context.Args().Get( 1 )
-  x1 := context.Int( "x1" )
-  y1 := context.Int( "y1" )
-  x2 := context.Int( "x2" )
-  y2 := context.Int( "y2" )
+  template := context.Args().Get( 1 )
+  backgroundValue := strings.ToLower( strings.TrimSpace( context.String( "background" ) ) )
+  connectivity := context.Int( "connectivity" )
+  minArea := context.Int( "min-area" )
+  padding := context.Int( "padding" )
   quality := context.Int( "quality" )
 
   if quality < 0 || quality > 100 {
     return nil, fmt.Errorf( "Quality must be between 0 and 100, but got %d.", quality )
   }
 
-  if x1 < 0 || y1 < 0 || x2 < 0 || y2 < 0 {
-    return nil, fmt.Errorf( "Coordinates cannot be negative." )
+  if connectivity != 4 && connectivity != 8 {
+    return nil, fmt.Errorf( "The connectivity must be 4 or 8, but got %d.", connectivity )
   }
 
-  if x2 <= x1 {
-    return nil, fmt.Errorf( "x2 must be greater than x1 ( got x1=%d, x2=%d ).", x1, x2 )
+  if minArea < 1 {
+    return nil, fmt.Errorf( "The minimum area must be at least 1 pixel, but got %d.", minArea )
   }
 
-  if y2 <= y1 {
-    return nil, fmt.Errorf( "y2 must be greater than y1 ( got y1=%d, y2=%d ).", y1, y2 )
+  if padding < 0 || padding > maxDimension {
+    return nil, fmt.Errorf( "The padding must be between 0 and %d pixels, but got %d.", maxDimension, padding )
   }
 
-  sourceImage, format, err := loadImage( inputPath )
+  fuzz, err := parseFuzz( context.String( "fuzz" ) )
+  if err != nil {
+    return nil, err
+  }
+
+  var background color.RGBA64
+  if backgroundValue != "auto" {
+    parsed, err := parseColor( backgroundValue )
+    if err != nil {
+      return nil, err
+    }
+    background = color.RGBA64Model.Convert( parsed ).( color.RGBA64 )
+  }
+
+  sourceImage, format, _, err := loadOrientedImage( inputPath, !context.Bool( "no-auto-orient" ) )
   if err != nil {
     return nil, fmt.Errorf(
       "The image file %s could not be decoded ( possibly corrupt or unsupported format ): %w",
@@ -645,85 +5562,148 @@ func clipImage( context *cli.Context ) ( *ClipResult, error ) {
       inputPath, originalWidth, originalHeight )
   }
 
-  if x2 > originalWidth {
-    return nil, fmt.Errorf( "The x2 coordinate ( %d ) exceeds the image width ( %d ).", x2, originalWidth )
+  if backgroundValue == "auto" {
+    background = detectBackground( sourceImage, fuzz )
   }
 
-  if y2 > originalHeight {
-    return nil, fmt.Errorf( "The y2 coordinate ( %d ) exceeds the image height ( %d ).", y2, originalHeight )
+  components, labels := findSprites( sourceImage, background, fuzz, connectivity )
+  if len( components ) == 0 {
+    return nil, fmt.Errorf( "The image %s only contains the background color %s.", inputPath, formatColor( background ) )
   }
 
-  clipWidth := x2 - x1
-  clipHeight := y2 - y1
-
-  // create the clipped image by drawing the source region onto a new image
-  clippedImage := image.NewRGBA( image.Rect( 0, 0, clipWidth, clipHeight ) )
-  sourceRect := image.Rect( x1, y1, x2, y2 )
-
-  draw.Draw(
-    clippedImage,
-    clippedImage.Bounds(),
-    sourceImage,
-    sourceRect.Min,
-    draw.Src,
-  )
+  found, largest := len( components ), 0
+  kept := components[ :0 ]
+  for _, component := range components {
+    largest = max( largest, component.Area )
+    if component.Area >= minArea {
+      kept = append( kept, component )
+    }
+  }
+  if len( kept ) == 0 {
+    return nil, fmt.Errorf( "No sprite in %s has at least %d pixels ( the largest of %d has %d ).",
+      inputPath, minArea, found, largest )
+  }
 
-  message := fmt.Sprintf( "Clipping %s [%s] region ( %d,%d )-( %d,%d ) -> %dx%d",
-    filepath.Base( inputPath ),
-    format,
-    x1, y1, x2, y2,
-    clipWidth, clipHeight,
-  )
+  if len( kept ) > maxSprites {
+    return nil, fmt.Errorf( "The image has %d sprites, more than the limit of %d ( try a larger --fuzz or --min-area ).",
+      len( kept ), maxSprites )
+  }
 
-  outputExtension := strings.ToLower( filepath.Ext( outputPath ) )
-  err = encodeOutput( outputPath, outputExtension, clippedImage, quality, format )
-  if err != nil {
-    return nil, fmt.Errorf( "The output file %s could not be written: %w", outputPath, err )
+  if template != "" && len( kept ) > 1 && !strings.Contains( template, "{index}" ) {
+    return nil, fmt.Errorf( "The output template %s must contain {index} to write more than one sprite.", template )
   }
 
-  result := &ClipResult{
+  outputExtension := strings.ToLower( filepath.Ext( template ) )
+  imageRect := image.Rect( 0, 0, originalWidth, originalHeight )
+
+  result := &SpritesResult{
     InputFile:    inputPath,
-    OutputFile:   outputPath,
     Format:       format,
     OriginalSize: Size{ Width: originalWidth, Height: originalHeight },
-    ClipSize:     Size{ Width: clipWidth, Height: clipHeight },
-    Message:      message,
+    Background:   formatColor( background ),
+    Fuzz:         fuzz,
+    Connectivity: connectivity,
+    Padding:      padding,
+    Sprites:      make( []Sprite, 0, len( kept ) ),
+  }
+
+  for index, component := range kept {
+    box := component.Rect
+    region := box.Inset( -padding ).Intersect( imageRect )
+
+    sprite := Sprite{
+      Index:       index + 1,
+      BoundingBox: Region{ X1: box.Min.X, Y1: box.Min.Y, X2: box.Max.X, Y2: box.Max.Y },
+      Region:      Region{ X1: region.Min.X, Y1: region.Min.Y, X2: region.Max.X, Y2: region.Max.Y },
+      Size:        Size{ Width: region.Dx(), Height: region.Dy() },
+      Area:        component.Area,
+    }
+
+    if template != "" {
+      sprite.OutputFile = expandTemplate( template, strconv.Itoa( index + 1 ), index + 1 )
+      isolated := isolateSprite( sourceImage, labels, component.Label, region, background )
+      err := encodeOutput( sprite.OutputFile, outputExtension, isolated, quality, format )
+      if err != nil {
+        return nil, fmt.Errorf( "The output file %s could not be written: %w", sprite.OutputFile, err )
+      }
+    }
+
+    result.Sprites = append( result.Sprites, sprite )
+  }
+
+  result.Message = fmt.Sprintf( "Found %d sprites in %s [%s] %dx%d on background %s",
+    len( result.Sprites ),
+    filepath.Base( inputPath ),
+    format,
+    originalWidth, originalHeight,
+    formatColor( background ),
+  )
+  if skipped := found - len( kept ); skipped > 0 {
+    result.Message += fmt.Sprintf( " ( %d smaller than %d pixels left out )", skipped, minArea )
   }
-  result.ClipRegion.X1 = x1
-  result.ClipRegion.Y1 = y1
-  result.ClipRegion.X2 = x2
-  result.ClipRegion.Y2 = y2
 
   return result, nil
 }
 
-func encodeOutput( path string, extension string, img image.Image, quality int, inputFormat string ) error {
-  outputFile, err := os.Create( path )
-  if err != nil {
-    return fmt.Errorf( "The output file %s could not be created: %w", path, err )
+// opaqueBackground turns a fully transparent background white for output formats
+// without an alpha channel, which would otherwise show it as black
+func opaqueBackground( background color.NRGBA, extension string, inputFormat string ) color.NRGBA {
+  if background.A == 0 {
+    switch effectiveOutputExtension( extension, inputFormat ) {
+    case ".jpg", ".jpeg", ".gif":
+      return color.NRGBA{ 255, 255, 255, 255 }
+    }
   }
+  return background
+}
 
+func effectiveOutputExtension( extension string, inputFormat string ) string {
   // for unknown extensions, use input format ( fall back to jpeg for formats we can't write )
   supportedExtensions := map[ string ]bool{
     ".png": true, ".gif": true, ".jpg": true, ".jpeg": true, ".tif": true, ".tiff": true, ".bmp": true,
   }
 
-  effectiveExtension := extension
-  if !supportedExtensions[ extension ] {
-    switch inputFormat {
-    case "png":
-      effectiveExtension = ".png"
-    case "gif":
-      effectiveExtension = ".gif"
-    case "tiff":
-      effectiveExtension = ".tiff"
-    case "bmp":
-      effectiveExtension = ".bmp"
-    default:
-      effectiveExtension = ".jpeg"
-    }
+  if supportedExtensions[ extension ] {
+    return extension
+  }
+
+  switch inputFormat {
+  case "png":
+    return ".png"
+  case "gif":
+    return ".gif"
+  case "tiff":
+    return ".tiff"
+  case "bmp":
+    return ".bmp"
   }
 
+  return ".jpeg"
+}
+
+// validateDepth checks a requested bit depth ( 0 keeps the source depth ) against what
+// the output encoder can write
+func validateDepth( depth int, extension string, inputFormat string ) error {
+  if depth != 0 && depth != 8 && depth != 16 {
+    return fmt.Errorf( "Depth must be 8 or 16 bits, but got %d.", depth )
+  }
+
+  effectiveExtension := effectiveOutputExtension( extension, inputFormat )
+  if depth == 16 && effectiveExtension != ".png" && effectiveExtension != ".tif" && effectiveExtension != ".tiff" {
+    return fmt.Errorf( "A depth of 16 bits is only supported for PNG and TIFF output, not %s.", effectiveExtension )
+  }
+
+  return nil
+}
+
+func encodeOutput( path string, extension string, img image.Image, quality int, inputFormat string ) error {
+  outputFile, err := os.Create( path )
+  if err != nil {
+    return fmt.Errorf( "The output file %s could not be created: %w", path, err )
+  }
+
+  effectiveExtension := effectiveOutputExtension( extension, inputFormat )
+
   switch effectiveExtension {
   case ".png":
     err = png.Encode( outputFile, img )
@@ -1,11 +1,20 @@
 package main
 
 import (
+  "bytes"
   "fmt"
   "image"
+  "image/color"
+  "image/jpeg"
+  "math"
   "os"
   "path/filepath"
+  "runtime"
+  "sync"
   "testing"
+
+  "golang.org/x/image/draw"
+  "golang.org/x/image/math/f64"
 )
 
 func TestLoadImageJPEG( t *testing.T ) {
@@ -268,25 +277,25 @@ func TestRotateImage270( t *testing.T ) {
 
 func TestRotateValidation( t *testing.T ) {
   tests := []struct {
-    degrees   int
-    shouldErr bool
+    degrees  float64
+    expected float64
   }{
-    { 0, false },
-    { 90, false },
-    { 180, false },
-    { 270, false },
-    { 45, true },
-    { -90, true },
-    { 360, true },
+    { 0, 0 },
+    { 90, 90 },
+    { 180, 180 },
+    { 270, 270 },
+    { 45, 45 },
+    { 7.5, 7.5 },
+    { -90, 270 },
+    { -7.5, 352.5 },
+    { 360, 0 },
+    { 450, 90 },
   }
 
   for _, tt := range tests {
-    t.Run( fmt.Sprintf( "rotate_%d", tt.degrees ), func( t *testing.T ) {
-      isValid := tt.degrees == 0 || tt.degrees == 90 || tt.degrees == 180 || tt.degrees == 270
-      hasErr := !isValid
-
-      if hasErr != tt.shouldErr {
-        t.Errorf( "Expected error state %v for %d degrees, but got %v.", tt.shouldErr, tt.degrees, hasErr )
+    t.Run( fmt.Sprintf( "rotate_%g", tt.degrees ), func( t *testing.T ) {
+      if actual := normalizeAngle( tt.degrees ); actual != tt.expected {
+        t.Errorf( "Expected %g degrees to normalize to %g, but got %g.", tt.degrees, tt.expected, actual )
       }
     } )
   }
@@ -742,3 +751,1935 @@ func TestClipOutputFormats( t *testing.T ) {
     } )
   }
 }
+
+func TestParseFilter( t *testing.T ) {
+  tests := []struct {
+    name      string
+    canonical string
+    shouldErr bool
+  }{
+    { "nearest", "nearest", false },
+    { "bilinear", "bilinear", false },
+    { "", "bilinear", false },
+    { "catmull-rom", "catmull-rom", false },
+    { "Lanczos3", "lanczos3", false },
+    { "box", "box", false },
+    { "area", "box", false },
+    { "sinc", "", true },
+  }
+
+  for _, tt := range tests {
+    t.Run( fmt.Sprintf( "filter_%s", tt.name ), func( t *testing.T ) {
+      filter, canonical, err := parseFilter( tt.name )
+
+      if ( err != nil ) != tt.shouldErr {
+        t.Fatalf( "Expected error state %v for filter '%s', but got %v.", tt.shouldErr, tt.name, err )
+      }
+
+      if tt.shouldErr {
+        return
+      }
+
+      if filter == nil {
+        t.Error( "The filter should not be nil." )
+      }
+
+      if canonical != tt.canonical {
+        t.Errorf( "Expected canonical filter name '%s', but got '%s'.", tt.canonical, canonical )
+      }
+    } )
+  }
+}
+
+func TestResizeImageFilters( t *testing.T ) {
+  sourceImage, _, err := loadImage( "testdata/test.jpeg" )
+  if err != nil {
+    t.Fatalf( "The source image could not be loaded: %v", err )
+  }
+
+  for _, name := range []string{ "nearest", "bilinear", "catmull-rom", "lanczos3", "box" } {
+    t.Run( name, func( t *testing.T ) {
+      filter, _, err := parseFilter( name )
+      if err != nil {
+        t.Fatalf( "The filter could not be parsed: %v", err )
+      }
+
+      resized := resizeImage( sourceImage, sourceImage.Bounds(), 64, 48, resizeOptions{ Filter: filter } )
+
+      bounds := resized.Bounds()
+      if bounds.Dx() != 64 || bounds.Dy() != 48 {
+        t.Errorf( "Expected dimensions 64x48, but got %dx%d.", bounds.Dx(), bounds.Dy() )
+      }
+    } )
+  }
+}
+
+func TestParseGravity( t *testing.T ) {
+  tests := []struct {
+    name      string
+    x, y      float64
+    shouldErr bool
+  }{
+    { "center", 0.5, 0.5, false },
+    { "north", 0.5, 0, false },
+    { "SouthEast", 1, 1, false },
+    { "west", 0, 0.5, false },
+    { "middle", 0, 0, true },
+  }
+
+  for _, tt := range tests {
+    t.Run( tt.name, func( t *testing.T ) {
+      anchor, err := parseGravity( tt.name )
+
+      if ( err != nil ) != tt.shouldErr {
+        t.Fatalf( "Expected error state %v for gravity '%s', but got %v.", tt.shouldErr, tt.name, err )
+      }
+
+      if !tt.shouldErr && ( anchor.X != tt.x || anchor.Y != tt.y ) {
+        t.Errorf( "Expected anchor %.1f,%.1f, but got %.1f,%.1f.", tt.x, tt.y, anchor.X, anchor.Y )
+      }
+    } )
+  }
+}
+
+func TestCoverRegion( t *testing.T ) {
+  bounds := image.Rect( 0, 0, 1600, 900 )
+
+  tests := []struct {
+    name          string
+    width, height int
+    gravity       string
+    noEnlarge     bool
+    expectRect    image.Rectangle
+    expectWidth   int
+    expectHeight  int
+  }{
+    { "square center", 400, 400, "center", false, image.Rect( 350, 0, 1250, 900 ), 400, 400 },
+    { "square west", 400, 400, "west", false, image.Rect( 0, 0, 900, 900 ), 400, 400 },
+    { "square east", 400, 400, "east", false, image.Rect( 700, 0, 1600, 900 ), 400, 400 },
+    { "wide north", 1600, 400, "north", false, image.Rect( 0, 0, 1600, 400 ), 1600, 400 },
+    { "wide south", 1600, 400, "south", false, image.Rect( 0, 500, 1600, 900 ), 1600, 400 },
+    { "enlarged", 2000, 2000, "center", false, image.Rect( 350, 0, 1250, 900 ), 2000, 2000 },
+    { "no enlarge", 2000, 2000, "center", true, image.Rect( 350, 0, 1250, 900 ), 900, 900 },
+  }
+
+  for _, tt := range tests {
+    t.Run( tt.name, func( t *testing.T ) {
+      anchor, err := parseGravity( tt.gravity )
+      if err != nil {
+        t.Fatalf( "The gravity could not be parsed: %v", err )
+      }
+
+      rect, width, height := coverRegion( bounds, tt.width, tt.height, anchor, tt.noEnlarge )
+
+      if rect != tt.expectRect {
+        t.Errorf( "Expected crop %v, but got %v.", tt.expectRect, rect )
+      }
+
+      if width != tt.expectWidth || height != tt.expectHeight {
+        t.Errorf( "Expected output %dx%d, but got %dx%d.", tt.expectWidth, tt.expectHeight, width, height )
+      }
+    } )
+  }
+}
+
+func TestParseColor( t *testing.T ) {
+  tests := []struct {
+    value     string
+    expected  color.NRGBA
+    shouldErr bool
+  }{
+    { "transparent", color.NRGBA{ 0, 0, 0, 0 }, false },
+    { "white", color.NRGBA{ 255, 255, 255, 255 }, false },
+    { "#ff8000", color.NRGBA{ 255, 128, 0, 255 }, false },
+    { "00ff0080", color.NRGBA{ 0, 255, 0, 128 }, false },
+    { "#f80", color.NRGBA{ 255, 136, 0, 255 }, false },
+    { "rgb(10, 20, 30)", color.NRGBA{ 10, 20, 30, 255 }, false },
+    { "rgba(10,20,30,0.5)", color.NRGBA{ 10, 20, 30, 128 }, false },
+    { "#12345", color.NRGBA{}, true },
+    { "rgb(300,0,0)", color.NRGBA{}, true },
+    { "rgba(0,0,0,2)", color.NRGBA{}, true },
+    { "purple-ish", color.NRGBA{}, true },
+  }
+
+  for _, tt := range tests {
+    t.Run( tt.value, func( t *testing.T ) {
+      parsed, err := parseColor( tt.value )
+
+      if ( err != nil ) != tt.shouldErr {
+        t.Fatalf( "Expected error state %v for color '%s', but got %v.", tt.shouldErr, tt.value, err )
+      }
+
+      if !tt.shouldErr && parsed != tt.expected {
+        t.Errorf( "Expected color %v, but got %v.", tt.expected, parsed )
+      }
+    } )
+  }
+}
+
+func TestPadImage( t *testing.T ) {
+  content := image.NewRGBA( image.Rect( 0, 0, 40, 20 ) )
+  draw.Draw( content, content.Bounds(), image.NewUniform( color.RGBA{ 255, 0, 0, 255 } ), image.Point{}, draw.Src )
+
+  background := color.NRGBA{ 0, 0, 255, 255 }
+  padded := padImage( content, 40, 40, image.Pt( 0, 10 ), background )
+
+  bounds := padded.Bounds()
+  if bounds.Dx() != 40 || bounds.Dy() != 40 {
+    t.Fatalf( "Expected dimensions 40x40, but got %dx%d.", bounds.Dx(), bounds.Dy() )
+  }
+
+  if r, _, b, _ := padded.At( 20, 5 ).RGBA(); r != 0 || b != 0xffff {
+    t.Error( "The padding above the content should be filled with the background color." )
+  }
+
+  if r, _, b, _ := padded.At( 20, 20 ).RGBA(); r != 0xffff || b != 0 {
+    t.Error( "The content should be placed at the requested offset." )
+  }
+
+  if r, _, b, _ := padded.At( 20, 35 ).RGBA(); r != 0 || b != 0xffff {
+    t.Error( "The padding below the content should be filled with the background color." )
+  }
+}
+
+func TestOpaqueBackground( t *testing.T ) {
+  white := color.NRGBA{ 255, 255, 255, 255 }
+  tests := []struct {
+    background          color.NRGBA
+    extension           string
+    format              string
+    expected            color.NRGBA
+  }{
+    { color.NRGBA{}, ".jpg", "png", white },
+    { color.NRGBA{}, ".gif", "png", white },
+    { color.NRGBA{}, ".png", "jpeg", color.NRGBA{} },
+    // unknown extensions follow the input format
+    { color.NRGBA{}, ".webp", "jpeg", white },
+    { color.NRGBA{}, ".webp", "png", color.NRGBA{} },
+    // chosen colors, even half transparent ones, are kept
+    { color.NRGBA{ 0, 0, 0, 255 }, ".jpg", "png", color.NRGBA{ 0, 0, 0, 255 } },
+    { color.NRGBA{ 255, 0, 0, 128 }, ".jpg", "png", color.NRGBA{ 255, 0, 0, 128 } },
+  }
+
+  for _, test := range tests {
+    if background := opaqueBackground( test.background, test.extension, test.format ); background != test.expected {
+      t.Errorf( "Expected %v for %v written as %s from %s, but got %v.",
+        test.expected, test.background, test.extension, test.format, background )
+    }
+  }
+}
+
+func TestParseScale( t *testing.T ) {
+  tests := []struct {
+    value     string
+    expected  float64
+    shouldErr bool
+  }{
+    { "", 0, false },
+    { "0.5", 0.5, false },
+    { "2x", 2, false },
+    { "50%", 0.5, false },
+    { "150%", 1.5, false },
+    { "0", 0, true },
+    { "-2x", 0, true },
+    { "half", 0, true },
+  }
+
+  for _, tt := range tests {
+    t.Run( fmt.Sprintf( "scale_%s", tt.value ), func( t *testing.T ) {
+      scale, err := parseScale( tt.value )
+
+      if ( err != nil ) != tt.shouldErr {
+        t.Fatalf( "Expected error state %v for scale '%s', but got %v.", tt.shouldErr, tt.value, err )
+      }
+
+      if !tt.shouldErr && scale != tt.expected {
+        t.Errorf( "Expected scale %g, but got %g.", tt.expected, scale )
+      }
+    } )
+  }
+}
+
+func TestStretchAndScaleDimensions( t *testing.T ) {
+  if width, height := stretchDimensions( 1920, 1080, 500, 500, false ); width != 500 || height != 500 {
+    t.Errorf( "Expected a stretch to 500x500, but got %dx%d.", width, height )
+  }
+
+  if width, height := stretchDimensions( 1920, 1080, 800, 0, false ); width != 800 || height != 1080 {
+    t.Errorf( "Expected a width-only stretch to 800x1080, but got %dx%d.", width, height )
+  }
+
+  if width, height := stretchDimensions( 800, 600, 1000, 300, true ); width != 800 || height != 300 {
+    t.Errorf( "Expected a stretch without enlargement to 800x300, but got %dx%d.", width, height )
+  }
+
+  if width, height := scaleDimensions( 1920, 1080, 0.5, false ); width != 960 || height != 540 {
+    t.Errorf( "Expected a 50%% scale to 960x540, but got %dx%d.", width, height )
+  }
+
+  if width, height := scaleDimensions( 800, 600, 2, true ); width != 800 || height != 600 {
+    t.Errorf( "Expected a 2x scale without enlargement to stay 800x600, but got %dx%d.", width, height )
+  }
+}
+
+func TestSizeLimitsConstrain( t *testing.T ) {
+  tests := []struct {
+    name          string
+    limits        sizeLimits
+    width, height int
+    expectWidth   int
+    expectHeight  int
+  }{
+    { "within budget", sizeLimits{ MaxPixels: 1150000 }, 1000, 1000, 1000, 1000 },
+    { "pixel budget", sizeLimits{ MaxPixels: 1150000 }, 4032, 3024, 1238, 928 },
+    { "long edge", sizeLimits{ MaxLongEdge: 800 }, 4032, 3024, 800, 600 },
+    { "short edge", sizeLimits{ MaxShortEdge: 512 }, 3024, 4032, 512, 683 },
+    { "combined", sizeLimits{ MaxPixels: 250000, MaxLongEdge: 1000 }, 4000, 1000, 1000, 250 },
+  }
+
+  for _, tt := range tests {
+    t.Run( tt.name, func( t *testing.T ) {
+      width, height := tt.limits.constrain( tt.width, tt.height )
+
+      if width != tt.expectWidth || height != tt.expectHeight {
+        t.Errorf( "Expected %dx%d, but got %dx%d.", tt.expectWidth, tt.expectHeight, width, height )
+      }
+
+      if tt.limits.MaxPixels > 0 && width * height > tt.limits.MaxPixels {
+        t.Errorf( "The result %dx%d exceeds the pixel budget of %d.", width, height, tt.limits.MaxPixels )
+      }
+    } )
+  }
+}
+
+func TestParsePixelCount( t *testing.T ) {
+  tests := []struct {
+    value     string
+    expected  int
+    shouldErr bool
+  }{
+    { "", 0, false },
+    { "1150000", 1150000, false },
+    { "1.15mp", 1150000, false },
+    { "2 MP", 2000000, false },
+    { "-5", 0, true },
+    { "lots", 0, true },
+  }
+
+  for _, tt := range tests {
+    t.Run( fmt.Sprintf( "pixels_%s", tt.value ), func( t *testing.T ) {
+      pixels, err := parsePixelCount( tt.value )
+
+      if ( err != nil ) != tt.shouldErr {
+        t.Fatalf( "Expected error state %v for '%s', but got %v.", tt.shouldErr, tt.value, err )
+      }
+
+      if !tt.shouldErr && pixels != tt.expected {
+        t.Errorf( "Expected %d pixels, but got %d.", tt.expected, pixels )
+      }
+    } )
+  }
+}
+
+func TestSmartCropFindsDetail( t *testing.T ) {
+  img := image.NewRGBA( image.Rect( 0, 0, 400, 200 ) )
+  draw.Draw( img, img.Bounds(), image.NewUniform( color.RGBA{ 128, 128, 128, 255 } ), image.Point{}, draw.Src )
+
+  // a checkerboard near the right edge is the only detail in the image
+  for y := 60; y < 140; y++ {
+    for x := 300; x < 380; x++ {
+      if ( x / 4 + y / 4 ) % 2 == 0 {
+        img.Set( x, y, color.RGBA{ 0, 0, 0, 255 } )
+      } else {
+        img.Set( x, y, color.RGBA{ 255, 255, 255, 255 } )
+      }
+    }
+  }
+
+  rect, score := smartCrop( img, 200, 200 )
+
+  if rect.Dx() != 200 || rect.Dy() != 200 {
+    t.Fatalf( "Expected a 200x200 crop, but got %dx%d.", rect.Dx(), rect.Dy() )
+  }
+
+  if rect.Min.X > 300 || rect.Max.X < 380 {
+    t.Errorf( "Expected the crop to contain the detailed region, but got %v.", rect )
+  }
+
+  if score < 0.9 {
+    t.Errorf( "Expected the crop to hold nearly all of the interest, but got a score of %.2f.", score )
+  }
+}
+
+func TestSmartCropFlatImage( t *testing.T ) {
+  img := image.NewRGBA( image.Rect( 0, 0, 300, 100 ) )
+  draw.Draw( img, img.Bounds(), image.NewUniform( color.RGBA{ 90, 90, 90, 255 } ), image.Point{}, draw.Src )
+
+  rect, score := smartCrop( img, 100, 100 )
+
+  if rect != image.Rect( 100, 0, 200, 100 ) {
+    t.Errorf( "Expected a centered crop for a flat image, but got %v.", rect )
+  }
+
+  if score != 0 {
+    t.Errorf( "Expected a score of zero for a flat image, but got %.2f.", score )
+  }
+}
+
+func TestSeamCarveDimensions( t *testing.T ) {
+  img := image.NewRGBA( image.Rect( 0, 0, 60, 40 ) )
+  for y := 0; y < 40; y++ {
+    for x := 0; x < 60; x++ {
+      img.Set( x, y, color.RGBA{ uint8( x * 4 ), uint8( y * 6 ), 128, 255 } )
+    }
+  }
+
+  tests := []struct {
+    name          string
+    width, height int
+  }{
+    { "narrower", 40, 40 },
+    { "shorter", 60, 25 },
+    { "wider", 100, 40 },
+    { "taller and narrower", 30, 70 },
+  }
+
+  for _, tt := range tests {
+    t.Run( tt.name, func( t *testing.T ) {
+      carved := seamCarve( img, nil, tt.width, tt.height )
+
+      bounds := carved.Bounds()
+      if bounds.Dx() != tt.width || bounds.Dy() != tt.height {
+        t.Errorf( "Expected dimensions %dx%d, but got %dx%d.", tt.width, tt.height, bounds.Dx(), bounds.Dy() )
+      }
+    } )
+  }
+}
+
+func TestSeamCarveKeepsDetail( t *testing.T ) {
+  // a flat background with a single detailed column block; carving must remove the
+  // flat area and leave the block intact
+  img := image.NewRGBA( image.Rect( 0, 0, 80, 30 ) )
+  draw.Draw( img, img.Bounds(), image.NewUniform( color.RGBA{ 200, 200, 200, 255 } ), image.Point{}, draw.Src )
+  for y := 0; y < 30; y++ {
+    for x := 50; x < 60; x++ {
+      if ( x + y ) % 2 == 0 {
+        img.Set( x, y, color.RGBA{ 0, 0, 0, 255 } )
+      }
+    }
+  }
+
+  carved := seamCarve( img, nil, 40, 30 )
+
+  darkColumns := 0
+  for x := 0; x < 40; x++ {
+    if r, _, _, _ := carved.At( x, 0 ).RGBA(); r < 0x8000 {
+      darkColumns++
+    }
+  }
+
+  if darkColumns != 5 {
+    t.Errorf( "Expected the 5 dark pixels of the detailed block to survive in the first row, but found %d.",
+      darkColumns )
+  }
+}
+
+func TestSeamCarveProtectMask( t *testing.T ) {
+  // with a flat image every seam is equally cheap, so the mask alone decides what stays
+  img := image.NewRGBA( image.Rect( 0, 0, 50, 20 ) )
+  draw.Draw( img, img.Bounds(), image.NewUniform( color.RGBA{ 100, 100, 100, 255 } ), image.Point{}, draw.Src )
+  for y := 0; y < 20; y++ {
+    for x := 0; x < 10; x++ {
+      img.Set( x, y, color.RGBA{ 100, 100, 101, 255 } )
+    }
+  }
+
+  mask := image.NewGray( image.Rect( 0, 0, 50, 20 ) )
+  for y := 0; y < 20; y++ {
+    for x := 0; x < 10; x++ {
+      mask.SetGray( x, y, color.Gray{ 255 } )
+    }
+  }
+
+  carved := seamCarve( img, mask, 20, 20 )
+
+  for x := 0; x < 10; x++ {
+    if _, _, b, _ := carved.At( x, 10 ).RGBA(); b >> 8 != 101 {
+      t.Fatalf( "Expected the protected columns to remain at the left edge, but column %d changed.", x )
+    }
+  }
+}
+
+func TestSeamCarveKeepsModel( t *testing.T ) {
+  deep := image.NewGray16( image.Rect( 0, 0, 30, 20 ) )
+  for y := 0; y < 20; y++ {
+    for x := 0; x < 30; x++ {
+      deep.SetGray16( x, y, color.Gray16{ uint16( 0x1001 + x * 0x0101 + y ) } )
+    }
+  }
+
+  for _, size := range []image.Point{ { 20, 15 }, { 40, 25 } } {
+    carved, ok := seamCarve( deep, nil, size.X, size.Y ).( *image.Gray16 )
+    if !ok {
+      t.Fatalf( "Expected a Gray16 result for %v.", size )
+    }
+    // 8-bit values widen to equal high and low bytes, so any difference shows 16-bit precision
+    fine := false
+    for index := 0; index < len( carved.Pix ); index += 2 {
+      fine = fine || carved.Pix[ index ] != carved.Pix[ index + 1 ]
+    }
+    if !fine {
+      t.Errorf( "Expected the carved %v image to keep 16-bit values.", size )
+    }
+  }
+
+  wide := image.NewNRGBA64( image.Rect( 0, 0, 10, 4 ) )
+  for y := 0; y < 4; y++ {
+    for x := 0; x < 10; x++ {
+      wide.SetNRGBA64( x, y, color.NRGBA64{ uint16( x * 0x1801 ), 0x0102, 0xfffe, 0xffff } )
+    }
+  }
+  carved, ok := seamCarve( wide, nil, 14, 4 ).( *image.NRGBA64 )
+  if !ok {
+    t.Fatalf( "Expected an NRGBA64 result when inserting seams." )
+  }
+  for index := 0; index < len( carved.Pix ); index += 8 {
+    if green := uint16( carved.Pix[ index + 2 ] ) << 8 | uint16( carved.Pix[ index + 3 ] ); green != 0x0102 {
+      t.Fatalf( "Expected inserted seams to blend at 16 bits, but got the green value %#04x.", green )
+    }
+  }
+
+  gray := image.NewGray( image.Rect( 0, 0, 12, 8 ) )
+  if _, ok := seamCarve( gray, nil, 8, 8 ).( *image.Gray ); !ok {
+    t.Errorf( "Expected a Gray result for a Gray source." )
+  }
+
+  paletted := image.NewPaletted( image.Rect( 0, 0, 12, 8 ), color.Palette{ color.Black, color.White } )
+  if _, ok := seamCarve( paletted, nil, 16, 8 ).( *image.NRGBA ); !ok {
+    t.Errorf( "Expected an NRGBA result for a paletted source, whose palette cannot hold blended seams." )
+  }
+}
+
+func TestResizeImageLinearLight( t *testing.T ) {
+  // alternating black and white columns average to 50% gray in sRGB space, but to
+  // the brighter sRGB value of half the light ( about 188 ) in linear light
+  img := image.NewRGBA( image.Rect( 0, 0, 64, 8 ) )
+  for y := 0; y < 8; y++ {
+    for x := 0; x < 64; x++ {
+      if x % 2 == 0 {
+        img.Set( x, y, color.RGBA{ 255, 255, 255, 255 } )
+      } else {
+        img.Set( x, y, color.RGBA{ 0, 0, 0, 255 } )
+      }
+    }
+  }
+
+  gamma := resizeImage( img, img.Bounds(), 8, 1, resizeOptions{ Filter: boxKernel } )
+  linear := resizeImage( img, img.Bounds(), 8, 1, resizeOptions{ Filter: boxKernel, Linear: true } )
+
+  gammaValue, _, _, _ := gamma.At( 4, 0 ).RGBA()
+  linearValue, _, _, _ := linear.At( 4, 0 ).RGBA()
+
+  if gammaValue >> 8 < 120 || gammaValue >> 8 > 135 {
+    t.Errorf( "Expected an sRGB average near 128, but got %d.", gammaValue >> 8 )
+  }
+
+  if linearValue >> 8 < 180 || linearValue >> 8 > 195 {
+    t.Errorf( "Expected a linear light average near 188, but got %d.", linearValue >> 8 )
+  }
+}
+
+func TestLinearLightRoundTrip( t *testing.T ) {
+  img := image.NewNRGBA( image.Rect( 0, 0, 256, 2 ) )
+  for x := 0; x < 256; x++ {
+    img.SetNRGBA( x, 0, color.NRGBA{ uint8( x ), uint8( 255 - x ), 40, 255 } )
+    img.SetNRGBA( x, 1, color.NRGBA{ uint8( x ), 90, 200, 128 } )
+  }
+
+  roundTrip := fromLinearLight( toLinearLight( img, img.Bounds(), 4 ), image.NewRGBA( img.Bounds() ), 4 )
+
+  for y := 0; y < 2; y++ {
+    for x := 0; x < 256; x++ {
+      expected := color.NRGBAModel.Convert( img.At( x, y ) ).( color.NRGBA )
+      actual := color.NRGBAModel.Convert( roundTrip.At( x, y ) ).( color.NRGBA )
+
+      if absDiff( expected.R, actual.R ) > 2 || absDiff( expected.G, actual.G ) > 2 ||
+        absDiff( expected.B, actual.B ) > 2 || expected.A != actual.A {
+        t.Fatalf( "The pixel at %d,%d changed from %v to %v after a linear light round trip.", x, y, expected, actual )
+      }
+    }
+  }
+}
+
+func absDiff( a uint8, b uint8 ) uint8 {
+  if a > b {
+    return a - b
+  }
+  return b - a
+}
+
+func TestPreservePixelModel( t *testing.T ) {
+  gray16 := image.NewGray16( image.Rect( 0, 0, 64, 48 ) )
+  for x := 0; x < 64; x++ {
+    gray16.SetGray16( x, 10, color.Gray16{ uint16( x * 1000 + 7 ) } )
+  }
+
+  resized := resizeImage( gray16, gray16.Bounds(), 32, 24, resizeOptions{ Filter: draw.CatmullRom } )
+  if _, ok := resized.( *image.Gray16 ); !ok {
+    t.Errorf( "Expected a resized Gray16 image to stay Gray16, but got %s.", colorModelName( resized ) )
+  }
+
+  linear := resizeImage( gray16, gray16.Bounds(), 32, 24, resizeOptions{ Filter: draw.BiLinear, Linear: true } )
+  if _, ok := linear.( *image.Gray16 ); !ok {
+    t.Errorf( "Expected a linear light resize of Gray16 to stay Gray16, but got %s.", colorModelName( linear ) )
+  }
+
+  rotated := rotateImage( gray16, 90 )
+  if _, ok := rotated.( *image.Gray16 ); !ok {
+    t.Fatalf( "Expected a rotated Gray16 image to stay Gray16, but got %s.", colorModelName( rotated ) )
+  }
+  if rotated.( *image.Gray16 ).Gray16At( 37, 5 ).Y != 5007 {
+    t.Error( "Rotation should keep the full 16-bit sample values." )
+  }
+
+  palette := color.Palette{ color.Black, color.White, color.NRGBA{ 255, 0, 0, 255 } }
+  paletted := image.NewPaletted( image.Rect( 0, 0, 20, 20 ), palette )
+
+  if _, ok := resizeImage( paletted, paletted.Bounds(), 10, 10, resizeOptions{ Filter: draw.NearestNeighbor } ).( *image.Paletted ); !ok {
+    t.Error( "Expected a nearest neighbour resize to keep the palette." )
+  }
+
+  if _, ok := resizeImage( paletted, paletted.Bounds(), 10, 10, resizeOptions{ Filter: draw.BiLinear } ).( *image.NRGBA ); !ok {
+    t.Error( "Expected an interpolated resize of a paletted image to produce NRGBA." )
+  }
+
+  if _, ok := rotateImage( paletted, 180 ).( *image.Paletted ); !ok {
+    t.Error( "Expected rotation to keep the palette." )
+  }
+
+  if _, ok := resizeImage( image.NewYCbCr( image.Rect( 0, 0, 16, 16 ), image.YCbCrSubsampleRatio420 ), image.Rect( 0, 0, 16, 16 ),
+    8, 8, resizeOptions{ Filter: draw.BiLinear } ).( *image.RGBA ); !ok {
+    t.Error( "Expected YCbCr images to be resized into RGBA." )
+  }
+}
+
+func TestPadImagePromotesModel( t *testing.T ) {
+  gray := image.NewGray( image.Rect( 0, 0, 10, 10 ) )
+
+  if _, ok := padImage( gray, 20, 20, image.Pt( 5, 5 ), color.NRGBA{ 255, 255, 255, 255 } ).( *image.Gray ); !ok {
+    t.Error( "Expected padding a gray image with white to stay Gray." )
+  }
+
+  padded := padImage( gray, 20, 20, image.Pt( 5, 5 ), color.NRGBA{} )
+  if _, ok := padded.( *image.NRGBA ); !ok {
+    t.Fatalf( "Expected padding a gray image with transparency to produce NRGBA, but got %s.", colorModelName( padded ) )
+  }
+  if _, _, _, a := padded.At( 0, 0 ).RGBA(); a != 0 {
+    t.Error( "The padding should be transparent." )
+  }
+
+  gray16 := image.NewGray16( image.Rect( 0, 0, 10, 10 ) )
+  if _, ok := padImage( gray16, 20, 20, image.Pt( 5, 5 ), color.NRGBA{ 255, 0, 0, 255 } ).( *image.NRGBA64 ); !ok {
+    t.Error( "Expected padding a Gray16 image with a color to produce NRGBA64." )
+  }
+}
+
+func TestConvertDepth( t *testing.T ) {
+  tests := []struct {
+    source   image.Image
+    depth    int
+    expected string
+  }{
+    { image.NewGray( image.Rect( 0, 0, 2, 2 ) ), 16, "Gray16" },
+    { image.NewGray( image.Rect( 0, 0, 2, 2 ) ), 8, "Gray" },
+    { image.NewGray16( image.Rect( 0, 0, 2, 2 ) ), 8, "Gray" },
+    { image.NewNRGBA( image.Rect( 0, 0, 2, 2 ) ), 16, "NRGBA64" },
+    { image.NewNRGBA64( image.Rect( 0, 0, 2, 2 ) ), 8, "NRGBA" },
+    { image.NewRGBA64( image.Rect( 0, 0, 2, 2 ) ), 8, "RGBA" },
+    { image.NewRGBA( image.Rect( 0, 0, 2, 2 ) ), 16, "RGBA64" },
+    { image.NewYCbCr( image.Rect( 0, 0, 2, 2 ), image.YCbCrSubsampleRatio444 ), 16, "RGBA64" },
+    { image.NewRGBA64( image.Rect( 0, 0, 2, 2 ) ), 0, "RGBA64" },
+  }
+
+  for _, test := range tests {
+    converted := convertDepth( test.source, test.depth )
+    if name := colorModelName( converted ); name != test.expected {
+      t.Errorf( "Converting %s to depth %d: expected %s, but got %s.",
+        colorModelName( test.source ), test.depth, test.expected, name )
+    }
+  }
+
+  gray := image.NewGray( image.Rect( 0, 0, 1, 1 ) )
+  gray.SetGray( 0, 0, color.Gray{ 0x80 } )
+  if value := convertDepth( gray, 16 ).( *image.Gray16 ).Gray16At( 0, 0 ).Y; value != 0x8080 {
+    t.Errorf( "Expected the 16-bit value 0x8080, but got %#x.", value )
+  }
+}
+
+func TestValidateDepth( t *testing.T ) {
+  valid := []struct {
+    depth     int
+    extension string
+    format    string
+  }{
+    { 0, ".jpg", "jpeg" },
+    { 8, ".jpg", "png" },
+    { 16, ".png", "jpeg" },
+    { 16, ".tiff", "jpeg" },
+    { 16, ".webp", "png" },
+  }
+
+  for _, test := range valid {
+    if err := validateDepth( test.depth, test.extension, test.format ); err != nil {
+      t.Errorf( "Expected depth %d with %s to be valid, but got: %v", test.depth, test.extension, err )
+    }
+  }
+
+  invalid := []struct {
+    depth     int
+    extension string
+    format    string
+  }{
+    { 12, ".png", "png" },
+    { 16, ".jpg", "png" },
+    { 16, ".gif", "png" },
+    { 16, ".bmp", "png" },
+    { 16, ".webp", "jpeg" },
+  }
+
+  for _, test := range invalid {
+    if err := validateDepth( test.depth, test.extension, test.format ); err == nil {
+      t.Errorf( "Expected depth %d with %s to be rejected.", test.depth, test.extension )
+    }
+  }
+}
+
+func TestRotateAnyAngle( t *testing.T ) {
+  img := image.NewRGBA( image.Rect( 0, 0, 200, 100 ) )
+  draw.Draw( img, img.Bounds(), image.NewUniform( color.RGBA{ 255, 0, 0, 255 } ), image.Point{}, draw.Src )
+  background := color.NRGBA{ 0, 0, 255, 255 }
+
+  kept := rotateAnyAngle( img, 30, false, background, draw.BiLinear )
+  if bounds := kept.Bounds(); bounds.Dx() != 200 || bounds.Dy() != 100 {
+    t.Errorf( "Expected the original 200x100 size without expand, but got %dx%d.", bounds.Dx(), bounds.Dy() )
+  }
+
+  expanded := rotateAnyAngle( img, 30, true, background, draw.BiLinear )
+  // 200 cos 30 + 100 sin 30 = 223.2, 200 sin 30 + 100 cos 30 = 186.6
+  if bounds := expanded.Bounds(); bounds.Dx() != 224 || bounds.Dy() != 187 {
+    t.Errorf( "Expected an expanded size of 224x187, but got %dx%d.", bounds.Dx(), bounds.Dy() )
+  }
+
+  if r, _, b, _ := expanded.At( 112, 93 ).RGBA(); r != 0xffff || b != 0 {
+    t.Error( "The center of the rotated image should keep the source color." )
+  }
+
+  if r, _, b, _ := expanded.At( 1, 1 ).RGBA(); r != 0 || b != 0xffff {
+    t.Error( "The uncovered corners should be filled with the background color." )
+  }
+
+  if r, _, b, _ := kept.At( 0, 0 ).RGBA(); r != 0 || b != 0xffff {
+    t.Error( "The uncovered corners should be filled with the background color without expand." )
+  }
+
+  transparent := rotateAnyAngle( img, -10, true, color.NRGBA{}, draw.BiLinear )
+  if _, _, _, a := transparent.At( 0, 0 ).RGBA(); a != 0 {
+    t.Error( "A transparent background should leave the corners transparent." )
+  }
+
+  right := rotateAnyAngle( img, -90, false, background, draw.BiLinear )
+  if bounds := right.Bounds(); bounds.Dx() != 100 || bounds.Dy() != 200 {
+    t.Errorf( "Expected a right angle rotation to swap the dimensions, but got %dx%d.", bounds.Dx(), bounds.Dy() )
+  }
+
+  gray := image.NewGray( image.Rect( 0, 0, 50, 50 ) )
+  if _, ok := rotateAnyAngle( gray, 15, true, color.NRGBA{ 255, 255, 255, 255 }, draw.BiLinear ).( *image.Gray ); !ok {
+    t.Error( "Rotating a gray image onto a white background should stay Gray." )
+  }
+}
+
+func TestOrientImage( t *testing.T ) {
+  img := image.NewGray( image.Rect( 0, 0, 3, 2 ) )
+  for y := 0; y < 2; y++ {
+    for x := 0; x < 3; x++ {
+      img.SetGray( x, y, color.Gray{ uint8( y * 3 + x ) } )
+    }
+  }
+
+  // each expected image is listed row by row
+  tests := []struct {
+    name        string
+    orientation orientation
+    width       int
+    expected    []uint8
+  }{
+    { "flip", flipOrientation, 3, []uint8{ 3, 4, 5, 0, 1, 2 } },
+    { "flop", flopOrientation, 3, []uint8{ 2, 1, 0, 5, 4, 3 } },
+    { "transpose", transposeOrientation, 2, []uint8{ 0, 3, 1, 4, 2, 5 } },
+    { "transverse", transverseOrientation, 2, []uint8{ 5, 2, 4, 1, 3, 0 } },
+    { "rotate 90", rotationOrientation( 90 ), 2, []uint8{ 3, 0, 4, 1, 5, 2 } },
+    { "rotate 270", rotationOrientation( 270 ), 2, []uint8{ 2, 5, 1, 4, 0, 3 } },
+    { "rotate 90 then flop", rotationOrientation( 90 ).then( flopOrientation ), 2, []uint8{ 0, 3, 1, 4, 2, 5 } },
+    { "flip then flop", flipOrientation.then( flopOrientation ), 3, []uint8{ 5, 4, 3, 2, 1, 0 } },
+  }
+
+  for _, tt := range tests {
+    t.Run( tt.name, func( t *testing.T ) {
+      oriented, ok := orientImage( img, tt.orientation ).( *image.Gray )
+      if !ok {
+        t.Fatal( "Expected the oriented image to stay Gray." )
+      }
+
+      if oriented.Bounds().Dx() != tt.width {
+        t.Fatalf( "Expected a width of %d, but got %d.", tt.width, oriented.Bounds().Dx() )
+      }
+
+      for i, value := range tt.expected {
+        if actual := oriented.GrayAt( i % tt.width, i / tt.width ).Y; actual != value {
+          t.Errorf( "Expected %d at %d,%d, but got %d.", value, i % tt.width, i / tt.width, actual )
+        }
+      }
+    } )
+  }
+}
+
+func writeOrientedJPEG( t *testing.T, path string, number int ) {
+  // white on the left half, black on the right
+  img := image.NewGray( image.Rect( 0, 0, 16, 8 ) )
+  draw.Draw( img, image.Rect( 0, 0, 8, 8 ), image.White, image.Point{}, draw.Src )
+
+  var encoded bytes.Buffer
+  if err := jpeg.Encode( &encoded, img, &jpeg.Options{ Quality: 95 } ); err != nil {
+    t.Fatalf( "The test image could not be encoded: %v", err )
+  }
+
+  // a big endian TIFF header with a single orientation entry in the first IFD
+  exif := []byte( "Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01" )
+  exif = append( exif, 0, byte( number ), 0, 0, 0, 0, 0, 0 )
+  segment := append( []byte{ 0xff, 0xe1, 0, byte( len( exif ) + 2 ) }, exif... )
+
+  data := append( []byte{ 0xff, 0xd8 }, segment... )
+  data = append( data, encoded.Bytes()[ 2: ]... )
+  if err := os.WriteFile( path, data, 0644 ); err != nil {
+    t.Fatalf( "The test image could not be written: %v", err )
+  }
+}
+
+func TestLoadImageEXIFOrientation( t *testing.T ) {
+  path := filepath.Join( t.TempDir(), "oriented.jpg" )
+  writeOrientedJPEG( t, path, 6 )
+
+  img, _, number, err := loadOrientedImage( path, true )
+  if err != nil {
+    t.Fatalf( "The image could not be loaded: %v", err )
+  }
+
+  if number != 6 {
+    t.Errorf( "Expected orientation 6, but got %d.", number )
+  }
+
+  // orientation 6 is turned upright by rotating 90 degrees clockwise
+  if bounds := img.Bounds(); bounds.Dx() != 8 || bounds.Dy() != 16 {
+    t.Fatalf( "Expected the upright image to be 8x16, but got %dx%d.", bounds.Dx(), bounds.Dy() )
+  }
+
+  if top, _, _, _ := img.At( 4, 2 ).RGBA(); top < 0xe000 {
+    t.Error( "The left half of the stored image should be at the top after orienting." )
+  }
+
+  if bottom, _, _, _ := img.At( 4, 13 ).RGBA(); bottom > 0x2000 {
+    t.Error( "The right half of the stored image should be at the bottom after orienting." )
+  }
+
+  stored, _, number, err := loadOrientedImage( path, false )
+  if err != nil {
+    t.Fatalf( "The image could not be loaded: %v", err )
+  }
+
+  if bounds := stored.Bounds(); number != 6 || bounds.Dx() != 16 || bounds.Dy() != 8 {
+    t.Errorf( "Expected the stored 16x8 pixels with orientation 6, but got %dx%d with %d.",
+      bounds.Dx(), bounds.Dy(), number )
+  }
+
+  _, _, number, err = loadOrientedImage( "testdata/test.jpeg", true )
+  if err != nil || number != 1 {
+    t.Errorf( "Expected orientation 1 for an image without EXIF data, but got %d ( %v ).", number, err )
+  }
+}
+
+func TestHeifOrientation( t *testing.T ) {
+  box := func( boxType string, contents ...[]byte ) []byte {
+    data := bytes.Join( contents, nil )
+    return append( []byte{ 0, 0, 0, byte( len( data ) + 8 ) }, append( []byte( boxType ), data... )... )
+  }
+
+  // primary item 1 rotated 90 degrees counter-clockwise, then mirrored left to right
+  data := box( "meta", []byte{ 0, 0, 0, 0 },
+    box( "pitm", []byte{ 0, 0, 0, 0, 0, 1 } ),
+    box( "iprp",
+      box( "ipco", box( "irot", []byte{ 1 } ), box( "imir", []byte{ 1 } ) ),
+      box( "ipma", []byte{ 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 2, 0x81, 0x02 } ),
+    ),
+  )
+
+  applied := heifOrientation( data )
+  if number := orientationNumber( applied ); number != 7 {
+    t.Errorf( "Expected orientation 7 ( transverse ), but got %d.", number )
+  }
+
+  if applied.then( applied.inverse() ) != identityOrientation {
+    t.Error( "An orientation followed by its inverse should be the identity." )
+  }
+
+  heic, err := os.ReadFile( "testdata/test.heic" )
+  if err != nil {
+    t.Fatalf( "The HEIC file could not be read: %v", err )
+  }
+
+  if number := orientationNumber( heifOrientation( heic ) ); number != 1 {
+    t.Errorf( "Expected the test HEIC file to be upright, but got orientation %d.", number )
+  }
+}
+
+func testImages( width int, height int ) map[ string ]image.Image {
+  rgba := image.NewRGBA( image.Rect( 0, 0, width, height ) )
+  nrgba := image.NewNRGBA( image.Rect( 0, 0, width, height ) )
+  nrgba64 := image.NewNRGBA64( image.Rect( 0, 0, width, height ) )
+  gray := image.NewGray( image.Rect( 0, 0, width, height ) )
+  gray16 := image.NewGray16( image.Rect( 0, 0, width, height ) )
+  paletted := image.NewPaletted( image.Rect( 0, 0, width, height ), color.Palette{ color.Black, color.White, color.Transparent } )
+  ycbcr := image.NewYCbCr( image.Rect( 0, 0, width, height ), image.YCbCrSubsampleRatio420 )
+
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      value := uint8( x * 7 + y * 13 )
+      rgba.SetRGBA( x, y, color.RGBA{ value / 2, value / 3, value / 4, value / 2 + 100 } )
+      nrgba.SetNRGBA( x, y, color.NRGBA{ value, 255 - value, value / 2, value | 1 } )
+      nrgba64.SetNRGBA64( x, y, color.NRGBA64{ uint16( x * 1000 ), uint16( y * 1000 ), 7, 0xffff } )
+      gray.SetGray( x, y, color.Gray{ value } )
+      gray16.SetGray16( x, y, color.Gray16{ uint16( x * 511 + y ) } )
+      paletted.SetColorIndex( x, y, value % 3 )
+      ycbcr.Y[ ycbcr.YOffset( x, y ) ] = value
+      ycbcr.Cb[ ycbcr.COffset( x, y ) ] = uint8( x * 3 )
+      ycbcr.Cr[ ycbcr.COffset( x, y ) ] = uint8( y * 5 )
+    }
+  }
+
+  return map[ string ]image.Image{
+    "RGBA": rgba, "NRGBA": nrgba, "NRGBA64": nrgba64, "Gray": gray, "Gray16": gray16, "Paletted": paletted, "YCbCr": ycbcr,
+  }
+}
+
+func TestOrientImageFastPaths( t *testing.T ) {
+  orientations := []orientation{
+    rotationOrientation( 90 ), rotationOrientation( 180 ), rotationOrientation( 270 ),
+    flipOrientation, flopOrientation, transposeOrientation, transverseOrientation,
+  }
+
+  // odd sizes larger than a block exercise partial blocks and chroma subsampling
+  for name, img := range testImages( 77, 131 ) {
+    for _, o := range orientations {
+      width, height, offsetX, offsetY := o.placement( 77, 131 )
+      expected := newCanvas( img, image.Rect( 0, 0, width, height ), true )
+      orientGeneric( expected, img, o, offsetX, offsetY )
+
+      actual := orientImage( img, o )
+      if colorModelName( actual ) != colorModelName( expected ) {
+        t.Fatalf( "%s %v: expected %s, but got %s.", name, o, colorModelName( expected ), colorModelName( actual ) )
+      }
+
+      for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+          if actual.At( x, y ) != expected.At( x, y ) {
+            t.Fatalf( "%s %v: the pixel at %d,%d is %v, but the generic path gives %v.",
+              name, o, x, y, actual.At( x, y ), expected.At( x, y ) )
+          }
+        }
+      }
+    }
+  }
+}
+
+func TestCropImage( t *testing.T ) {
+  for name, img := range testImages( 40, 30 ) {
+    // a sub-image has a non-zero origin and a stride wider than its rows
+    source := img.( interface{ SubImage( image.Rectangle ) image.Image } ).SubImage( image.Rect( 5, 3, 40, 30 ) )
+    rect := image.Rect( 9, 7, 31, 26 )
+
+    cropped := cropImage( source, rect )
+    if bounds := cropped.Bounds(); bounds != image.Rect( 0, 0, 22, 19 ) {
+      t.Fatalf( "%s: expected bounds of 22x19 at the origin, but got %v.", name, bounds )
+    }
+
+    for y := 0; y < rect.Dy(); y++ {
+      for x := 0; x < rect.Dx(); x++ {
+        expected := cropped.ColorModel().Convert( source.At( rect.Min.X + x, rect.Min.Y + y ) )
+        if actual := cropped.At( x, y ); actual != expected {
+          t.Fatalf( "%s: the pixel at %d,%d is %v, but expected %v.", name, x, y, actual, expected )
+        }
+      }
+    }
+  }
+}
+
+func benchmarkOrient( b *testing.B, name string, fast bool ) {
+  img := testImages( 2000, 1500 )[ name ]
+  o := rotationOrientation( 90 )
+  width, height, offsetX, offsetY := o.placement( 2000, 1500 )
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if fast {
+      orientImage( img, o )
+    } else {
+      orientGeneric( newCanvas( img, image.Rect( 0, 0, width, height ), true ), img, o, offsetX, offsetY )
+    }
+  }
+}
+
+func BenchmarkRotate90RGBA( b *testing.B )          { benchmarkOrient( b, "RGBA", true ) }
+func BenchmarkRotate90RGBAGeneric( b *testing.B )   { benchmarkOrient( b, "RGBA", false ) }
+func BenchmarkRotate90NRGBA( b *testing.B )         { benchmarkOrient( b, "NRGBA", true ) }
+func BenchmarkRotate90NRGBAGeneric( b *testing.B )  { benchmarkOrient( b, "NRGBA", false ) }
+func BenchmarkRotate90YCbCr( b *testing.B )         { benchmarkOrient( b, "YCbCr", true ) }
+func BenchmarkRotate90YCbCrGeneric( b *testing.B )  { benchmarkOrient( b, "YCbCr", false ) }
+func BenchmarkRotate90Gray( b *testing.B )          { benchmarkOrient( b, "Gray", true ) }
+func BenchmarkRotate90GrayGeneric( b *testing.B )   { benchmarkOrient( b, "Gray", false ) }
+
+func benchmarkCrop( b *testing.B, name string, fast bool ) {
+  img := testImages( 2000, 1500 )[ name ]
+  rect := image.Rect( 100, 100, 1900, 1400 )
+
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if fast {
+      cropImage( img, rect )
+    } else {
+      // the draw.Draw copy that clip used before the typed-pixel path
+      cropped := newCanvas( img, image.Rect( 0, 0, rect.Dx(), rect.Dy() ), true )
+      draw.Draw( cropped, cropped.Bounds(), img, rect.Min, draw.Src )
+    }
+  }
+}
+
+func BenchmarkCropNRGBA( b *testing.B )             { benchmarkCrop( b, "NRGBA", true ) }
+func BenchmarkCropNRGBADraw( b *testing.B )         { benchmarkCrop( b, "NRGBA", false ) }
+func BenchmarkCropGray( b *testing.B )              { benchmarkCrop( b, "Gray", true ) }
+func BenchmarkCropGrayDraw( b *testing.B )          { benchmarkCrop( b, "Gray", false ) }
+
+func TestParallelScaleMatchesSerial( t *testing.T ) {
+  filters := []string{ "nearest", "bilinear", "catmull-rom", "lanczos3", "box" }
+  sizes := []image.Point{ { 20, 50 }, { 150, 40 }, { 160, 300 }, { 3, 1 } }
+  sourceRect := image.Rect( 3, 5, 70, 120 )
+
+  for name, img := range testImages( 77, 131 ) {
+    for _, filterName := range filters {
+      filter, _, err := parseFilter( filterName )
+      if err != nil {
+        t.Fatal( err )
+      }
+
+      for _, size := range sizes {
+        rect := image.Rect( 0, 0, size.X, size.Y )
+        serial := newCanvas( img, rect, false )
+        filter.Scale( serial, rect, img, sourceRect, draw.Src, nil )
+
+        for _, threads := range []int{ 2, 7 } {
+          parallel := newCanvas( img, rect, false )
+          parallelScale( parallel, img, sourceRect, filter, threads )
+
+          serialPix, _, _, _ := pixelLayout( serial )
+          parallelPix, _, _, _ := pixelLayout( parallel )
+          if !bytes.Equal( serialPix, parallelPix ) {
+            t.Errorf( "%s with %s to %dx%d on %d threads differs from the serial output.",
+              name, filterName, size.X, size.Y, threads )
+          }
+        }
+      }
+    }
+  }
+}
+
+func TestParallelRows( t *testing.T ) {
+  for _, count := range []int{ 0, 1, 5, 1000 } {
+    for _, threads := range []int{ 1, 3, 64 } {
+      visits := make( []int, count )
+      var lock sync.Mutex
+
+      parallelRows( count, threads, func( start int, end int ) {
+        lock.Lock()
+        defer lock.Unlock()
+        for row := start; row < end; row++ {
+          visits[ row ]++
+        }
+      } )
+
+      for row, visited := range visits {
+        if visited != 1 {
+          t.Fatalf( "Row %d of %d was visited %d times with %d threads.", row, count, visited, threads )
+        }
+      }
+    }
+  }
+}
+
+func benchmarkScale( b *testing.B, threads int ) {
+  img := testImages( 2000, 1500 )[ "YCbCr" ]
+  rect := image.Rect( 0, 0, 640, 480 )
+
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    parallelScale( image.NewRGBA( rect ), img, img.Bounds(), lanczos3Kernel, threads )
+  }
+}
+
+func BenchmarkScaleLanczos3Serial( b *testing.B )   { benchmarkScale( b, 1 ) }
+func BenchmarkScaleLanczos3Parallel( b *testing.B ) { benchmarkScale( b, runtime.GOMAXPROCS( 0 ) ) }
+
+func TestParseFuzz( t *testing.T ) {
+  valid := map[ string ]float64{ "": 0, "0": 0, "5%": 5, "12.5": 12.5, "100%": 100 }
+  for value, expected := range valid {
+    fuzz, err := parseFuzz( value )
+    if err != nil || fuzz != expected {
+      t.Errorf( "Expected %q to parse as %g, but got %g ( %v ).", value, expected, fuzz, err )
+    }
+  }
+
+  for _, value := range []string{ "-1", "101%", "abc", "NaN" } {
+    if _, err := parseFuzz( value ); err == nil {
+      t.Errorf( "Expected %q to be rejected.", value )
+    }
+  }
+}
+
+func TestTrimBounds( t *testing.T ) {
+  img := image.NewNRGBA( image.Rect( 0, 0, 100, 80 ) )
+  draw.Draw( img, img.Bounds(), image.White, image.Point{}, draw.Src )
+  draw.Draw( img, image.Rect( 20, 10, 70, 60 ), image.Black, image.Point{}, draw.Src )
+  // a faint mark only counts as content without fuzz
+  img.SetNRGBA( 90, 75, color.NRGBA{ 250, 250, 250, 255 } )
+
+  background := detectBackground( img, 0 )
+  if formatColor( background ) != "#ffffff" {
+    t.Fatalf( "Expected a white background, but got %s.", formatColor( background ) )
+  }
+
+  if content := trimBounds( img, background, 0 ); content != image.Rect( 20, 10, 91, 76 ) {
+    t.Errorf( "Expected the content to include the faint mark, but got %v.", content )
+  }
+
+  if content := trimBounds( img, background, 5 ); content != image.Rect( 20, 10, 70, 60 ) {
+    t.Errorf( "Expected the fuzz to ignore the faint mark, but got %v.", content )
+  }
+
+  // an offset origin should be kept in image coordinates
+  sub := img.SubImage( image.Rect( 10, 5, 100, 80 ) )
+  if content := trimBounds( sub, background, 5 ); content != image.Rect( 20, 10, 70, 60 ) {
+    t.Errorf( "Expected the same content in a sub-image, but got %v.", content )
+  }
+
+  blank := image.NewGray( image.Rect( 0, 0, 10, 10 ) )
+  if content := trimBounds( blank, detectBackground( blank, 0 ), 0 ); !content.Empty() {
+    t.Errorf( "Expected no content in a blank image, but got %v.", content )
+  }
+}
+
+func TestDetectBackground( t *testing.T ) {
+  img := image.NewNRGBA( image.Rect( 0, 0, 10, 10 ) )
+  draw.Draw( img, img.Bounds(), image.NewUniform( color.NRGBA{ 0, 128, 0, 255 } ), image.Point{}, draw.Src )
+  // content touching one corner should not win over the other three
+  img.SetNRGBA( 0, 0, color.NRGBA{ 255, 0, 0, 255 } )
+
+  if background := formatColor( detectBackground( img, 0 ) ); background != "#008000" {
+    t.Errorf( "Expected the background #008000, but got %s.", background )
+  }
+
+  transparent := image.NewNRGBA( image.Rect( 0, 0, 10, 10 ) )
+  transparent.SetNRGBA( 9, 9, color.NRGBA{ 255, 0, 0, 0 } )
+  if background := formatColor( detectBackground( transparent, 0 ) ); background != "#00000000" {
+    t.Errorf( "Expected a transparent background, but got %s.", background )
+  }
+}
+
+func TestMaskRegion( t *testing.T ) {
+  // coprime sizes, where 7 * ( 29.0 / 7 ) rounds up past the mask's edge in floating point
+  imageBounds := image.Rect( 0, 0, 7, 5 )
+  maskBounds := image.Rect( 0, 0, 29, 13 )
+  for _, test := range []struct {
+    rect                image.Rectangle
+    expected            image.Rectangle
+  }{
+    { image.Rect( 0, 0, 7, 5 ), image.Rect( 0, 0, 29, 13 ) },
+    { image.Rect( 2, 1, 7, 5 ), image.Rect( 8, 2, 29, 13 ) },
+    { image.Rect( 1, 1, 3, 4 ), image.Rect( 4, 2, 13, 11 ) },
+  } {
+    if region := maskRegion( test.rect, imageBounds, maskBounds ); region != test.expected {
+      t.Errorf( "Expected %v to map to %v on the mask, but got %v.", test.rect, test.expected, region )
+    }
+  }
+
+  // offset origins on both sides
+  region := maskRegion( image.Rect( 12, 21, 17, 25 ), image.Rect( 10, 20, 17, 25 ), image.Rect( 3, 3, 32, 16 ) )
+  if region != image.Rect( 11, 5, 32, 16 ) {
+    t.Errorf( "Expected the mask region ( 11,5 )-( 32,16 ), but got %v.", region )
+  }
+
+  for size := 1; size <= 40; size++ {
+    for maskSize := 1; maskSize <= 40; maskSize++ {
+      bounds := image.Rect( 0, 0, maskSize, maskSize )
+      if region := maskRegion( image.Rect( 0, 0, size, size ), image.Rect( 0, 0, size, size ), bounds ); region != bounds {
+        t.Fatalf( "Expected a %d pixel image to cover the whole %d pixel mask, but got %v.", size, maskSize, region )
+      }
+    }
+  }
+
+  // a rectangle reaching past the image is cut to it instead of panicking
+  mask := image.NewGray( maskBounds )
+  if cropped := cropImage( mask, image.Rect( 20, 10, 30, 14 ) ); cropped.Bounds() != image.Rect( 0, 0, 9, 3 ) {
+    t.Errorf( "Expected the crop to be limited to the image, but got %v.", cropped.Bounds() )
+  }
+}
+
+// testPage draws lines of dark "words" on white paper, like a scanned page of text
+func testPage( width int, height int, ink color.Color, paper color.Color ) *image.NRGBA {
+  page := image.NewNRGBA( image.Rect( 0, 0, width, height ) )
+  draw.Draw( page, page.Bounds(), image.NewUniform( paper ), image.Point{}, draw.Src )
+
+  for y := 40; y + 10 < height - 40; y += 26 {
+    x := 60
+    for word := 0; x < width - 60; word++ {
+      length := 20 + ( word * 37 + y ) % 50
+      draw.Draw( page, image.Rect( x, y, min( x + length, width - 60 ), y + 10 ), image.NewUniform( ink ), image.Point{}, draw.Src )
+      x += length + 12
+    }
+  }
+
+  return page
+}
+
+func TestDetectSkew( t *testing.T ) {
+  white := color.NRGBA{ 255, 255, 255, 255 }
+  black := color.NRGBA{ 0, 0, 0, 255 }
+  page := testPage( 800, 600, black, white )
+
+  for _, angle := range []float64{ 0, 3, -5.5, 12, -14.2 } {
+    skewed := rotateAnyAngle( page, angle, false, white, draw.BiLinear )
+    if skew := detectSkew( skewed, 15 ); math.Abs( skew - angle ) > 0.15 {
+      t.Errorf( "Expected a skew of about %g degrees, but got %g.", angle, skew )
+    }
+  }
+
+  // light text on a dark background is found the same way
+  inverted := rotateAnyAngle( testPage( 800, 600, white, black ), -4, false, black, draw.BiLinear )
+  if skew := detectSkew( inverted, 15 ); math.Abs( skew + 4 ) > 0.15 {
+    t.Errorf( "Expected a skew of about -4 degrees for light text, but got %g.", skew )
+  }
+
+  blank := image.NewGray( image.Rect( 0, 0, 200, 100 ) )
+  if skew := detectSkew( blank, 15 ); skew != 0 {
+    t.Errorf( "Expected no skew for a blank page, but got %g.", skew )
+  }
+
+  // the maximum angle bounds the search
+  if skew := detectSkew( rotateAnyAngle( page, 12, false, white, draw.BiLinear ), 5 ); math.Abs( skew ) > 5 {
+    t.Errorf( "Expected the skew to stay within 5 degrees, but got %g.", skew )
+  }
+}
+
+func TestOtsuThreshold( t *testing.T ) {
+  var histogram [ 256 ]int
+  histogram[ 20 ] = 100
+  histogram[ 30 ] = 50
+  histogram[ 200 ] = 400
+  histogram[ 220 ] = 300
+
+  if threshold := otsuThreshold( histogram ); threshold < 30 || threshold >= 200 {
+    t.Errorf( "Expected a threshold between the two groups, but got %d.", threshold )
+  }
+}
+
+func TestSquareToQuad( t *testing.T ) {
+  quads := [][ 4 ][ 2 ]float64{
+    { { 0, 0 }, { 100, 0 }, { 100, 50 }, { 0, 50 } },
+    { { 10, 20 }, { 210, 40 }, { 190, 300 }, { 30, 280 } },
+    { { 50, 10 }, { 120, 0 }, { 400, 300 }, { 0, 200 } },
+  }
+  square := [ 4 ][ 2 ]float64{ { 0, 0 }, { 1, 0 }, { 1, 1 }, { 0, 1 } }
+
+  for _, quad := range quads {
+    mapping, ok := squareToQuad( quad )
+    if !ok {
+      t.Fatalf( "Expected a mapping for %v.", quad )
+    }
+    for index, point := range square {
+      x, y := mapping.apply( point[ 0 ], point[ 1 ] )
+      if math.Abs( x - quad[ index ][ 0 ] ) > 1e-9 || math.Abs( y - quad[ index ][ 1 ] ) > 1e-9 {
+        t.Errorf( "Expected corner %d of %v, but got ( %g, %g ).", index, quad, x, y )
+      }
+    }
+  }
+}
+
+func TestIsConvexQuad( t *testing.T ) {
+  tests := []struct {
+    corners             [ 4 ][ 2 ]float64
+    convex              bool
+  }{
+    { [ 4 ][ 2 ]float64{ { 0, 0 }, { 10, 0 }, { 10, 10 }, { 0, 10 } }, true },
+    { [ 4 ][ 2 ]float64{ { 0, 0 }, { 0, 10 }, { 10, 10 }, { 10, 0 } }, true },
+    { [ 4 ][ 2 ]float64{ { 0, 0 }, { 10, 10 }, { 10, 0 }, { 0, 10 } }, false },
+    { [ 4 ][ 2 ]float64{ { 0, 0 }, { 10, 0 }, { 3, 3 }, { 0, 10 } }, false },
+    { [ 4 ][ 2 ]float64{ { 0, 0 }, { 5, 0 }, { 10, 0 }, { 0, 10 } }, false },
+  }
+
+  for _, test := range tests {
+    if convex := isConvexQuad( test.corners ); convex != test.convex {
+      t.Errorf( "Expected convex %v for %v, but got %v.", test.convex, test.corners, convex )
+    }
+  }
+
+  width, height := quadSize( [ 4 ][ 2 ]float64{ { 0, 0 }, { 300, 40 }, { 300, 200 }, { 10, 180 } } )
+  if width != 303 || height != 180 {
+    t.Errorf( "Expected an inferred size of 303x180, but got %dx%d.", width, height )
+  }
+}
+
+func TestWarpPerspective( t *testing.T ) {
+  source := image.NewNRGBA( image.Rect( 0, 0, 40, 30 ) )
+  for y := 0; y < 30; y++ {
+    for x := 0; x < 40; x++ {
+      source.SetNRGBA( x, y, color.NRGBA{ uint8( x * 6 ), uint8( y * 8 ), uint8( x * y ), 255 } )
+    }
+  }
+
+  // the whole image as the quadrilateral reproduces it, and an axis-aligned
+  // quadrilateral reproduces that crop
+  for _, filterName := range []string{ "nearest", "bilinear", "catmull-rom" } {
+    identity := warpPerspective( source, [ 4 ][ 2 ]float64{ { 0, 0 }, { 40, 0 }, { 40, 30 }, { 0, 30 } },
+      40, 30, filterName, color.Transparent, 2 )
+    crop := warpPerspective( source, [ 4 ][ 2 ]float64{ { 10, 5 }, { 30, 5 }, { 30, 25 }, { 10, 25 } },
+      20, 20, filterName, color.Transparent, 1 )
+    for y := 0; y < 30; y++ {
+      for x := 0; x < 40; x++ {
+        if got, want := identity.At( x, y ), source.At( x, y ); got != want {
+          t.Fatalf( "Expected %v at ( %d, %d ) with %s, but got %v.", want, x, y, filterName, got )
+        }
+        if x < 20 && y < 20 {
+          if got, want := crop.At( x, y ), source.At( x + 10, y + 5 ); got != want {
+            t.Fatalf( "Expected %v at ( %d, %d ) of the crop with %s, but got %v.", want, x, y, filterName, got )
+          }
+        }
+      }
+    }
+  }
+
+  // corners outside the image leave the background showing
+  outside := warpPerspective( source, [ 4 ][ 2 ]float64{ { -40, 0 }, { 40, 0 }, { 40, 30 }, { -40, 30 } },
+    80, 30, "bilinear", color.NRGBA{ 255, 0, 0, 255 }, 1 )
+  if got := outside.At( 5, 10 ); got != ( color.NRGBA{ 255, 0, 0, 255 } ) {
+    t.Errorf( "Expected the background outside the image, but got %v.", got )
+  }
+  if got, want := outside.At( 60, 10 ), source.At( 20, 10 ); got != want {
+    t.Errorf( "Expected %v inside the image, but got %v.", want, got )
+  }
+
+  // a trapezoid is rectified: its corners land in the corners of the output
+  marked := image.NewNRGBA( image.Rect( 0, 0, 100, 100 ) )
+  draw.Draw( marked, marked.Bounds(), image.White, image.Point{}, draw.Src )
+  corners := [ 4 ][ 2 ]float64{ { 30, 10 }, { 70, 10 }, { 95, 90 }, { 5, 90 } }
+  for _, corner := range corners {
+    draw.Draw( marked, image.Rect( int( corner[ 0 ] ) - 2, int( corner[ 1 ] ) - 2, int( corner[ 0 ] ) + 2, int( corner[ 1 ] ) + 2 ),
+      image.Black, image.Point{}, draw.Src )
+  }
+  rectified := warpPerspective( marked, corners, 50, 50, "nearest", color.Transparent, 1 )
+  for _, point := range []image.Point{ { 0, 0 }, { 49, 0 }, { 49, 49 }, { 0, 49 } } {
+    if r, _, _, _ := rectified.At( point.X, point.Y ).RGBA(); r != 0 {
+      t.Errorf( "Expected a marked corner at %v, but got %v.", point, rectified.At( point.X, point.Y ) )
+    }
+  }
+  if r, _, _, _ := rectified.At( 25, 25 ).RGBA(); r != 0xffff {
+    t.Errorf( "Expected white paper in the middle, but got %v.", rectified.At( 25, 25 ) )
+  }
+}
+
+func TestParseAffine( t *testing.T ) {
+  tests := []struct {
+    matrix              string
+    translate           string
+    scale               string
+    shear               string
+    rotate              float64
+    expected            [ 6 ]float64
+  }{
+    { "1,0.2,5,0,1,-3", "", "", "", 0, [ 6 ]float64{ 1, 0.2, 5, 0, 1, -3 } },
+    { "", "", "", "", 0, [ 6 ]float64{ 1, 0, 0, 0, 1, 0 } },
+    { "", "10,5", "2", "", 0, [ 6 ]float64{ 2, 0, 10, 0, 2, 5 } },
+    { "", "", "2,3", "", 0, [ 6 ]float64{ 2, 0, 0, 0, 3, 0 } },
+    { "", "", "", "45", 0, [ 6 ]float64{ 1, 1, 0, 0, 1, 0 } },
+    { "", "", "", "0,45", 0, [ 6 ]float64{ 1, 0, 0, 1, 1, 0 } },
+    { "", "", "", "", 90, [ 6 ]float64{ 0, -1, 0, 1, 0, 0 } },
+    // scale first, then rotate, then translate
+    { "", "4,0", "2", "", 90, [ 6 ]float64{ 0, -2, 4, 2, 0, 0 } },
+  }
+
+  for _, test := range tests {
+    matrix, err := parseAffine( test.matrix, test.translate, test.scale, test.shear, test.rotate )
+    if err != nil {
+      t.Errorf( "Expected no error for %+v, but got %v.", test, err )
+      continue
+    }
+    for index := range matrix {
+      if math.Abs( matrix[ index ] - test.expected[ index ] ) > 1e-9 {
+        t.Errorf( "Expected %v for %+v, but got %v.", test.expected, test, matrix )
+        break
+      }
+    }
+  }
+
+  invalid := [][ 5 ]string{
+    { "1,0,0,0,1", "", "", "" },
+    { "1,0,0,0,1,x", "", "", "" },
+    { "1,0,0,0,1,0", "5,5", "", "" },
+    { "", "5", "", "" },
+    { "", "", "1,2,3", "" },
+    { "", "", "", "90" },
+  }
+  for _, values := range invalid {
+    if _, err := parseAffine( values[ 0 ], values[ 1 ], values[ 2 ], values[ 3 ], 0 ); err == nil {
+      t.Errorf( "Expected an error for %q.", values )
+    }
+  }
+}
+
+func TestAffineImage( t *testing.T ) {
+  source := image.NewNRGBA( image.Rect( 0, 0, 20, 10 ) )
+  for y := 0; y < 10; y++ {
+    for x := 0; x < 20; x++ {
+      source.SetNRGBA( x, y, color.NRGBA{ uint8( x * 12 ), uint8( y * 25 ), 90, 255 } )
+    }
+  }
+  red := color.NRGBA{ 255, 0, 0, 255 }
+
+  // a whole-pixel translation copies pixels and fills the uncovered area
+  shifted := affineImage( source, f64.Aff3{ 1, 0, 3, 0, 1, 2 }, 20, 10, red, draw.NearestNeighbor )
+  for y := 0; y < 10; y++ {
+    for x := 0; x < 20; x++ {
+      want := color.Color( red )
+      if x >= 3 && y >= 2 {
+        want = source.At( x - 3, y - 2 )
+      }
+      if got := shifted.At( x, y ); got != want {
+        t.Fatalf( "Expected %v at ( %d, %d ), but got %v.", want, x, y, got )
+      }
+    }
+  }
+
+  // images that do not start at the origin are transformed relative to their corner
+  offset := source.SubImage( image.Rect( 5, 5, 15, 10 ) )
+  identity := affineImage( offset, f64.Aff3{ 1, 0, 0, 0, 1, 0 }, 10, 5, red, draw.BiLinear )
+  if got, want := identity.At( 0, 0 ), source.At( 5, 5 ); got != want {
+    t.Errorf( "Expected %v at the corner of a sub-image, but got %v.", want, got )
+  }
+
+  minX, minY, maxX, maxY := affineBounds( f64.Aff3{ 0, -1, 0, 1, 0, 0 }, 20, 10 )
+  if minX != -10 || minY != 0 || maxX != 0 || maxY != 20 {
+    t.Errorf( "Expected bounds ( -10, 0 )-( 0, 20 ), but got ( %g, %g )-( %g, %g ).", minX, minY, maxX, maxY )
+  }
+}
+
+func TestParseLength( t *testing.T ) {
+  tests := []struct {
+    value               string
+    expected            int
+    valid               bool
+  }{
+    { "120", 120, true },
+    { "-40", -40, true },
+    { "10%", 80, true },
+    { "-12.5%", -100, true },
+    { " 50% ", 400, true },
+    { "12.5", 0, false },
+    { "ten", 0, false },
+    { "%", 0, false },
+  }
+
+  for _, test := range tests {
+    length, err := parseLength( test.value, 800, "x offset" )
+    if test.valid && ( err != nil || length != test.expected ) {
+      t.Errorf( "Expected %d for %q, but got %d ( %v ).", test.expected, test.value, length, err )
+    }
+    if !test.valid && err == nil {
+      t.Errorf( "Expected an error for %q, but got %d.", test.value, length )
+    }
+  }
+}
+
+func TestResolveSpan( t *testing.T ) {
+  center, east := 0.5, 1.0
+  tests := []struct {
+    offset              string
+    length              string
+    anchor              *float64
+    start               int
+    size                int
+  }{
+    { "100", "200", nil, 100, 200 },
+    { "", "200", nil, 0, 200 },
+    { "100", "", nil, 100, 900 },
+    { "10%", "50%", nil, 100, 500 },
+    // negative offsets count from the far edge
+    { "-300", "", nil, 700, 300 },
+    { "-300", "100", nil, 700, 100 },
+    { "-10%", "", nil, 900, 100 },
+    // an anchor positions the region and the offset shifts it
+    { "", "200", &center, 400, 200 },
+    { "", "200", &east, 800, 200 },
+    { "-50", "200", &east, 750, 200 },
+    { "", "", &center, 0, 1000 },
+  }
+
+  for _, test := range tests {
+    start, size, err := resolveSpan( test.offset, test.length, 1000, test.anchor, "x offset", "width" )
+    if err != nil || start != test.start || size != test.size {
+      t.Errorf( "Expected start %d and size %d for %+v, but got %d and %d ( %v ).",
+        test.start, test.size, test, start, size, err )
+    }
+  }
+
+  for _, length := range []string{ "0", "-20", "0%" } {
+    if _, _, err := resolveSpan( "", length, 1000, nil, "x offset", "width" ); err == nil {
+      t.Errorf( "Expected an error for the width %q.", length )
+    }
+  }
+}
+
+func TestParseAspect( t *testing.T ) {
+  tests := []struct {
+    value               string
+    expected            float64
+    valid               bool
+  }{
+    { "16:9", 16.0 / 9, true },
+    { "1:1", 1, true },
+    { " 4 : 5 ", 0.8, true },
+    { "1.5", 1.5, true },
+    { "2.39:1", 2.39, true },
+    { "16:0", 0, false },
+    { "-1:2", 0, false },
+    { "1:2:3", 0, false },
+    { "wide", 0, false },
+  }
+
+  for _, test := range tests {
+    aspect, err := parseAspect( test.value )
+    if test.valid && ( err != nil || math.Abs( aspect - test.expected ) > 1e-9 ) {
+      t.Errorf( "Expected %g for %q, but got %g ( %v ).", test.expected, test.value, aspect, err )
+    }
+    if !test.valid && err == nil {
+      t.Errorf( "Expected an error for %q, but got %g.", test.value, aspect )
+    }
+  }
+}
+
+func TestAspectSize( t *testing.T ) {
+  tests := []struct {
+    width, height       int
+    ratio               float64
+    expectedWidth       int
+    expectedHeight      int
+  }{
+    { 1920, 1440, 16.0 / 9, 1920, 1080 },
+    { 1920, 1080, 1, 1080, 1080 },
+    { 1000, 2000, 4.0 / 5, 1000, 1250 },
+    { 1000, 1000, 1, 1000, 1000 },
+    { 3, 1000, 100, 3, 1 },
+  }
+
+  for _, test := range tests {
+    width, height := aspectSize( test.width, test.height, test.ratio )
+    if width != test.expectedWidth || height != test.expectedHeight {
+      t.Errorf( "Expected %dx%d for %dx%d at %g, but got %dx%d.", test.expectedWidth, test.expectedHeight,
+        test.width, test.height, test.ratio, width, height )
+    }
+  }
+}
+
+func TestLoadRegions( t *testing.T ) {
+  directory := t.TempDir()
+  files := map[ string ]string{
+    "regions.json": `[ { "name": "logo", "x1": 0, "y1": 0, "x2": 40, "y2": 20 }, { "x1": 5, "y1": 6, "x2": 7, "y2": 8 } ]`,
+    "regions.csv":  "name,x1,y1,x2,y2\n# comment\nlogo, 0, 0, 40, 20\n5,6,7,8\n",
+    "regions.txt":  `[ { "name": "logo", "x1": 0, "y1": 0, "x2": 40, "y2": 20 }, { "x1": 5, "y1": 6, "x2": 7, "y2": 8 } ]`,
+  }
+
+  for name, content := range files {
+    path := filepath.Join( directory, name )
+    if err := os.WriteFile( path, []byte( content ), 0644 ); err != nil {
+      t.Fatalf( "The regions file could not be written: %v", err )
+    }
+
+    regions, err := loadRegions( path )
+    if err != nil {
+      t.Errorf( "Expected %s to load, but got %v.", name, err )
+      continue
+    }
+    if len( regions ) != 2 || regions[ 0 ].Name != "logo" || regions[ 0 ].Rect != image.Rect( 0, 0, 40, 20 ) ||
+      regions[ 1 ].Name != "" || regions[ 1 ].Rect != image.Rect( 5, 6, 7, 8 ) {
+      t.Errorf( "Expected the logo and an unnamed region from %s, but got %+v.", name, regions )
+    }
+  }
+
+  invalid := map[ string ]string{
+    "missing.json":  `[ { "name": "a", "x1": 0, "y1": 0, "x2": 10 } ]`,
+    "unknown.json":  `[ { "name": "a", "x": 0, "y1": 0, "x2": 10, "y2": 10 } ]`,
+    "empty.json":    `[]`,
+    "fields.csv":    "a,1,2,3,4,5\n",
+    "number.csv":    "a,1,2,3,4\nb,1,2,x,4\n",
+    "typo.csv":      "logo,10,20,3O,40\nb,1,2,3,4\n",
+    "fraction.csv":  "1,2,3,4.5\n5,6,7,8\n",
+  }
+
+  for name, content := range invalid {
+    path := filepath.Join( directory, name )
+    if err := os.WriteFile( path, []byte( content ), 0644 ); err != nil {
+      t.Fatalf( "The regions file could not be written: %v", err )
+    }
+    if _, err := loadRegions( path ); err == nil {
+      t.Errorf( "Expected an error for %s.", name )
+    }
+  }
+
+  // reversed corners are kept as given so that they can be reported
+  path := filepath.Join( directory, "reversed.csv" )
+  os.WriteFile( path, []byte( "a,10,10,0,0\n" ), 0644 )
+  if regions, err := loadRegions( path ); err != nil || !regions[ 0 ].Rect.Empty() {
+    t.Errorf( "Expected an empty region for reversed corners, but got %+v ( %v ).", regions, err )
+  }
+}
+
+func TestExpandTemplate( t *testing.T ) {
+  if path := expandTemplate( "out/{name}-{index}.png", "logo", 3 ); path != "out/logo-3.png" {
+    t.Errorf( "Expected out/logo-3.png, but got %s.", path )
+  }
+  if path := expandTemplate( "single.png", "logo", 1 ); path != "single.png" {
+    t.Errorf( "Expected single.png, but got %s.", path )
+  }
+}
+
+func TestTileSpans( t *testing.T ) {
+  tests := []struct {
+    total, size         int
+    overlap             int
+    expected            []tileSpan
+  }{
+    { 1000, 300, 0, []tileSpan{ { 0, 300 }, { 300, 600 }, { 600, 900 }, { 900, 1000 } } },
+    { 900, 300, 0, []tileSpan{ { 0, 300 }, { 300, 600 }, { 600, 900 } } },
+    { 1000, 300, 50, []tileSpan{ { 0, 300 }, { 250, 550 }, { 500, 800 }, { 750, 1000 } } },
+    { 200, 300, 50, []tileSpan{ { 0, 200 } } },
+  }
+
+  for _, test := range tests {
+    spans := tileSpans( test.total, test.size, test.overlap )
+    if fmt.Sprint( spans ) != fmt.Sprint( test.expected ) {
+      t.Errorf( "Expected %v for %d in %d pixel tiles ( overlap %d ), but got %v.",
+        test.expected, test.total, test.size, test.overlap, spans )
+    }
+  }
+}
+
+func TestGridSpans( t *testing.T ) {
+  tests := []struct {
+    total, count        int
+    overlap             int
+    expected            []tileSpan
+  }{
+    { 900, 3, 0, []tileSpan{ { 0, 300 }, { 300, 600 }, { 600, 900 } } },
+    // without overlap the remainder is spread and the tiles never share pixels
+    { 1000, 3, 0, []tileSpan{ { 0, 334 }, { 334, 667 }, { 667, 1000 } } },
+    { 10, 3, 0, []tileSpan{ { 0, 4 }, { 4, 7 }, { 7, 10 } } },
+    { 11, 3, 2, []tileSpan{ { 0, 5 }, { 3, 8 }, { 6, 11 } } },
+    { 1000, 3, 10, []tileSpan{ { 0, 340 }, { 330, 670 }, { 660, 1000 } } },
+    { 1000, 2, 100, []tileSpan{ { 0, 550 }, { 450, 1000 } } },
+    { 500, 1, 40, []tileSpan{ { 0, 500 } } },
+  }
+
+  for _, test := range tests {
+    spans := gridSpans( test.total, test.count, test.overlap )
+    if fmt.Sprint( spans ) != fmt.Sprint( test.expected ) {
+      t.Errorf( "Expected %v for %d split %d ways ( overlap %d ), but got %v.",
+        test.expected, test.total, test.count, test.overlap, spans )
+    }
+  }
+}
+
+func TestFixedTileSize( t *testing.T ) {
+  if width, height, err := fixedTileSize( 300, 0, 1000, 800 ); err != nil || width != 300 || height != 800 {
+    t.Errorf( "Expected 300x800 tiles, but got %dx%d ( %v ).", width, height, err )
+  }
+  if width, height, err := fixedTileSize( maxDimension, maxDimension, 10, 10 ); err != nil || width != maxDimension || height != maxDimension {
+    t.Errorf( "Expected the largest tile size to be accepted, but got %dx%d ( %v ).", width, height, err )
+  }
+
+  // padded tiles are allocated whole, so sizes beyond the limit must fail before that
+  for _, size := range [][ 2 ]int{ { 70000, 70000 }, { 200000, 0 }, { 0, maxDimension + 1 } } {
+    if _, _, err := fixedTileSize( size[ 0 ], size[ 1 ], 100, 100 ); err == nil {
+      t.Errorf( "Expected an error for %dx%d tiles.", size[ 0 ], size[ 1 ] )
+    }
+  }
+}
+
+func TestExpandTileTemplate( t *testing.T ) {
+  if path := expandTileTemplate( "tiles/{row}_{col}.png", 3, 7, 12, 8 ); path != "tiles/03_7.png" {
+    t.Errorf( "Expected tiles/03_7.png, but got %s.", path )
+  }
+  if path := expandTileTemplate( "{row}-{col}.jpg", 0, 0, 1, 1 ); path != "0-0.jpg" {
+    t.Errorf( "Expected 0-0.jpg, but got %s.", path )
+  }
+}
+
+func TestOverflowRegion( t *testing.T ) {
+  tests := []struct {
+    requested           image.Rectangle
+    overflow            string
+    expected            image.Rectangle
+    valid               bool
+  }{
+    { image.Rect( 10, 10, 50, 50 ), "error", image.Rect( 10, 10, 50, 50 ), true },
+    { image.Rect( 60, 10, 120, 50 ), "error", image.Rectangle{}, false },
+    { image.Rect( -5, 10, 50, 50 ), "error", image.Rectangle{}, false },
+    { image.Rect( 60, 10, 120, 50 ), "clamp", image.Rect( 60, 10, 100, 50 ), true },
+    { image.Rect( -20, -20, 30, 30 ), "pad", image.Rect( 0, 0, 30, 30 ), true },
+    { image.Rect( 100, 0, 150, 50 ), "clamp", image.Rectangle{}, false },
+    { image.Rect( -50, -50, -10, -10 ), "pad", image.Rectangle{}, false },
+    // padding would allocate the whole region
+    { image.Rect( 0, 0, 100000, 100000 ), "pad", image.Rectangle{}, false },
+    { image.Rect( -3000000000, 0, 50, 50 ), "pad", image.Rectangle{}, false },
+    { image.Rect( 0, 0, 50, 65536 ), "pad", image.Rectangle{}, false },
+    { image.Rect( -65000, 0, 50, 50 ), "pad", image.Rect( 0, 0, 50, 50 ), true },
+    { image.Rect( 0, 0, 100000, 100000 ), "clamp", image.Rect( 0, 0, 100, 80 ), true },
+  }
+
+  for _, test := range tests {
+    region, err := overflowRegion( test.requested, 100, 80, test.overflow )
+    if test.valid && ( err != nil || region != test.expected ) {
+      t.Errorf( "Expected %v for %v with %s, but got %v ( %v ).", test.expected, test.requested, test.overflow, region, err )
+    }
+    if !test.valid && err == nil {
+      t.Errorf( "Expected an error for %v with %s, but got %v.", test.requested, test.overflow, region )
+    }
+  }
+}
+
+func TestWriteClipOverflow( t *testing.T ) {
+  source := image.NewNRGBA( image.Rect( 0, 0, 100, 80 ) )
+  draw.Draw( source, source.Bounds(), image.NewUniform( color.NRGBA{ 0, 0, 255, 255 } ), image.Point{}, draw.Src )
+  directory := t.TempDir()
+  red := color.NRGBA{ 255, 0, 0, 255 }
+
+  padPath := filepath.Join( directory, "pad.png" )
+  result, err := writeClip( source, image.Rect( 80, -10, 120, 30 ), nil, "pad", red, "source.png", padPath, ".png", "png", 90 )
+  if err != nil {
+    t.Fatalf( "The padded clip could not be written: %v", err )
+  }
+  if result.ClipSize != ( Size{ 40, 40 } ) || result.ClipRegion != ( Region{ 80, 0, 100, 30 } ) ||
+    result.RequestedRegion == nil || *result.RequestedRegion != ( Region{ 80, -10, 120, 30 } ) ||
+    result.PlacementOffset == nil || *result.PlacementOffset != ( Point{ 0, 10 } ) {
+    t.Errorf( "Expected a 40x40 clip of ( 80,0 )-( 100,30 ) placed at ( 0,10 ), but got %+v.", result )
+  }
+
+  padded, _, err := loadImage( padPath )
+  if err != nil {
+    t.Fatalf( "The padded clip could not be loaded: %v", err )
+  }
+  if r, _, b, _ := padded.At( 5, 5 ).RGBA(); r != 0xffff || b != 0 {
+    t.Errorf( "Expected the background above the image, but got %v.", padded.At( 5, 5 ) )
+  }
+  if r, _, b, _ := padded.At( 5, 15 ).RGBA(); r != 0 || b != 0xffff {
+    t.Errorf( "Expected the image below the padding, but got %v.", padded.At( 5, 15 ) )
+  }
+
+  clampPath := filepath.Join( directory, "clamp.png" )
+  result, err = writeClip( source, image.Rect( 80, -10, 120, 30 ), nil, "clamp", red, "source.png", clampPath, ".png", "png", 90 )
+  if err != nil {
+    t.Fatalf( "The clamped clip could not be written: %v", err )
+  }
+  if result.ClipSize != ( Size{ 20, 30 } ) || result.PlacementOffset != nil || result.RequestedRegion == nil {
+    t.Errorf( "Expected a 20x30 clamped clip, but got %+v.", result )
+  }
+}
+
+func TestParseShape( t *testing.T ) {
+  shape, err := parseShape( "50,40,30", "" )
+  if err != nil || shape.Name != "ellipse" || shape.Ellipse != [ 4 ]float64{ 50, 40, 30, 30 } {
+    t.Errorf( "Expected a circle, but got %+v ( %v ).", shape, err )
+  }
+  if bounds, err := shape.bounds(); err != nil || bounds != image.Rect( 20, 10, 80, 70 ) {
+    t.Errorf( "Expected the circle bounds ( 20,10 )-( 80,70 ), but got %v ( %v ).", bounds, err )
+  }
+
+  shape, err = parseShape( "", "10,5; 90.5,20; 40,60;" )
+  if err != nil || shape.Name != "polygon" || len( shape.Points ) != 3 {
+    t.Errorf( "Expected a triangle, but got %+v ( %v ).", shape, err )
+  }
+  if bounds, err := shape.bounds(); err != nil || bounds != image.Rect( 10, 5, 91, 60 ) {
+    t.Errorf( "Expected the triangle bounds ( 10,5 )-( 91,60 ), but got %v ( %v ).", bounds, err )
+  }
+
+  // coordinates too far out to convert to pixels are rejected rather than wrapped
+  for _, values := range [][ 2 ]string{ { "", "0,0;1e12,0;0,5" }, { "0,0,1e300", "" }, { "", "-65536,0;10,0;0,10" } } {
+    shape, err := parseShape( values[ 0 ], values[ 1 ] )
+    if err != nil {
+      t.Fatalf( "Expected %q to parse, but got %v.", values, err )
+    }
+    if bounds, err := shape.bounds(); err == nil {
+      t.Errorf( "Expected an error for the bounds of %q, but got %v.", values, bounds )
+    }
+  }
+
+  if shape, err := parseShape( "", "" ); shape != nil || err != nil {
+    t.Errorf( "Expected no shape, but got %+v ( %v ).", shape, err )
+  }
+
+  invalid := [][ 2 ]string{
+    { "50,40", "" },
+    { "50,40,0", "" },
+    { "50,40,10,-5", "" },
+    { "", "0,0;10,10" },
+    { "", "0,0;10;20,20" },
+    { "50,40,30", "0,0;10,0;0,10" },
+  }
+  for _, values := range invalid {
+    if _, err := parseShape( values[ 0 ], values[ 1 ] ); err == nil {
+      t.Errorf( "Expected an error for %q.", values )
+    }
+  }
+}
+
+func TestApplyShape( t *testing.T ) {
+  source := image.NewNRGBA( image.Rect( 0, 0, 100, 100 ) )
+  draw.Draw( source, source.Bounds(), image.NewUniform( color.NRGBA{ 0, 0, 255, 255 } ), image.Point{}, draw.Src )
+
+  // a circle clipped from its bounding box keeps the middle and clears the corners
+  circle, _ := parseShape( "50,50,40", "" )
+  bounds, _ := circle.bounds()
+  masked := applyShape( cropImage( source, bounds ), circle, bounds.Min, color.Transparent )
+  if masked.Bounds().Dx() != 80 || masked.Bounds().Dy() != 80 {
+    t.Fatalf( "Expected an 80x80 image, but got %v.", masked.Bounds() )
+  }
+  if _, _, _, a := masked.At( 40, 40 ).RGBA(); a != 0xffff {
+    t.Errorf( "Expected the middle of the circle to be opaque, but got %v.", masked.At( 40, 40 ) )
+  }
+  if _, _, _, a := masked.At( 2, 2 ).RGBA(); a != 0 {
+    t.Errorf( "Expected the corner outside the circle to be transparent, but got %v.", masked.At( 2, 2 ) )
+  }
+
+  // the edge is anti-aliased: some pixel along the top row of the circle is partly covered
+  partial := false
+  for x := 0; x < 80; x++ {
+    if _, _, _, a := masked.At( x, 0 ).RGBA(); a > 0 && a < 0xffff {
+      partial = true
+    }
+  }
+  if !partial {
+    t.Errorf( "Expected partly covered pixels along the edge of the circle." )
+  }
+
+  // the lower-left half of a square, filled with a background outside the triangle
+  triangle, _ := parseShape( "", "10,10;60,60;10,60" )
+  bounds, _ = triangle.bounds()
+  masked = applyShape( cropImage( source, bounds ), triangle, bounds.Min, color.NRGBA{ 255, 255, 255, 255 } )
+  if r, _, b, _ := masked.At( 5, 45 ).RGBA(); r != 0 || b != 0xffff {
+    t.Errorf( "Expected the image inside the triangle, but got %v.", masked.At( 5, 45 ) )
+  }
+  if r, _, b, _ := masked.At( 45, 5 ).RGBA(); r != 0xffff || b != 0xffff {
+    t.Errorf( "Expected the white background outside the triangle, but got %v.", masked.At( 45, 5 ) )
+  }
+}
+
+func TestFindSprites( t *testing.T ) {
+  sheet := image.NewNRGBA( image.Rect( 0, 0, 100, 60 ) )
+  red := image.NewUniform( color.NRGBA{ 255, 0, 0, 255 } )
+  draw.Draw( sheet, image.Rect( 10, 10, 30, 40 ), red, image.Point{}, draw.Src )
+  // a second block touching only the first block's corner
+  draw.Draw( sheet, image.Rect( 30, 40, 40, 50 ), red, image.Point{}, draw.Src )
+  draw.Draw( sheet, image.Rect( 60, 5, 90, 20 ), red, image.Point{}, draw.Src )
+  sheet.SetNRGBA( 95, 55, color.NRGBA{ 0, 0, 255, 255 } )
+
+  background := detectBackground( sheet, 0 )
+  // sprites are ordered by their first pixel, so the block at the top comes first
+  expected := []spriteComponent{
+    { 1, image.Rect( 60, 5, 90, 20 ), 450 },
+    { 2, image.Rect( 10, 10, 40, 50 ), 700 },
+    { 3, image.Rect( 95, 55, 96, 56 ), 1 },
+  }
+  sprites, labels := findSprites( sheet, background, 0, 8 )
+  if len( sprites ) != len( expected ) {
+    t.Fatalf( "Expected the sprites %v, but got %v.", expected, sprites )
+  }
+  for index := range expected {
+    if sprites[ index ] != expected[ index ] {
+      t.Errorf( "Expected sprite %d to be %v, but got %v.", index + 1, expected[ index ], sprites[ index ] )
+    }
+  }
+
+  if labels[ 45 * 100 + 35 ] != 2 || labels[ 55 * 100 + 95 ] != 3 || labels[ 0 ] != 0 {
+    t.Errorf( "Expected every pixel to carry the label of its sprite." )
+  }
+
+  sprites, _ = findSprites( sheet, background, 0, 4 )
+  if len( sprites ) != 4 || sprites[ 1 ].Rect != image.Rect( 10, 10, 30, 40 ) || sprites[ 2 ].Rect != image.Rect( 30, 40, 40, 50 ) {
+    t.Errorf( "Expected 4-connectivity to split the diagonal blocks, but got %v.", sprites )
+  }
+
+  // an opaque sheet with a faint texture, offset from the origin
+  opaque := image.NewNRGBA( image.Rect( 5, 5, 45, 25 ) )
+  draw.Draw( opaque, opaque.Bounds(), image.White, image.Point{}, draw.Src )
+  opaque.SetNRGBA( 6, 6, color.NRGBA{ 250, 250, 250, 255 } )
+  draw.Draw( opaque, image.Rect( 20, 10, 30, 20 ), image.Black, image.Point{}, draw.Src )
+
+  sprites, _ = findSprites( opaque, detectBackground( opaque, 5 ), 5, 8 )
+  if len( sprites ) != 1 || sprites[ 0 ].Rect != image.Rect( 15, 5, 25, 15 ) || sprites[ 0 ].Area != 100 {
+    t.Errorf( "Expected one sprite relative to the origin, but got %v.", sprites )
+  }
+
+  if sprites, _ := findSprites( image.NewNRGBA( image.Rect( 0, 0, 8, 8 ) ), color.RGBA64{}, 0, 8 ); len( sprites ) != 0 {
+    t.Errorf( "Expected no sprites in an empty image, but got %v.", sprites )
+  }
+}
+
+func TestIsolateSprite( t *testing.T ) {
+  // an L-shaped sprite wrapping a small square that sits inside its bounding box
+  sheet := image.NewNRGBA( image.Rect( 0, 0, 40, 40 ) )
+  red := image.NewUniform( color.NRGBA{ 255, 0, 0, 255 } )
+  blue := color.NRGBA{ 0, 0, 255, 255 }
+  draw.Draw( sheet, image.Rect( 0, 0, 30, 5 ), red, image.Point{}, draw.Src )
+  draw.Draw( sheet, image.Rect( 0, 0, 5, 30 ), red, image.Point{}, draw.Src )
+  draw.Draw( sheet, image.Rect( 15, 15, 25, 25 ), image.NewUniform( blue ), image.Point{}, draw.Src )
+
+  sprites, labels := findSprites( sheet, detectBackground( sheet, 0 ), 0, 8 )
+  if len( sprites ) != 2 {
+    t.Fatalf( "Expected 2 sprites, but got %v.", sprites )
+  }
+
+  outer := isolateSprite( sheet, labels, sprites[ 0 ].Label, sprites[ 0 ].Rect, color.Transparent )
+  if _, _, _, a := outer.At( 20, 20 ).RGBA(); a != 0 {
+    t.Errorf( "Expected the inner sprite to be cleared from the outer one, but got %v.", outer.At( 20, 20 ) )
+  }
+  if r, _, _, _ := outer.At( 2, 20 ).RGBA(); r != 0xffff {
+    t.Errorf( "Expected the outer sprite to be kept, but got %v.", outer.At( 2, 20 ) )
+  }
+
+  // padding reaching into the outer sprite leaves it out of the inner one
+  inner := isolateSprite( sheet, labels, sprites[ 1 ].Label, sprites[ 1 ].Rect.Inset( -12 ), color.White )
+  if inner.Bounds() != image.Rect( 0, 0, 34, 34 ) {
+    t.Fatalf( "Expected a 34x34 crop, but got %v.", inner.Bounds() )
+  }
+  if actual := color.NRGBAModel.Convert( inner.At( 0, 0 ) ); actual != ( color.NRGBA{ 255, 255, 255, 255 } ) {
+    t.Errorf( "Expected the outer sprite to be painted with the background, but got %v.", actual )
+  }
+  if actual := color.NRGBAModel.Convert( inner.At( 12, 12 ) ); actual != blue {
+    t.Errorf( "Expected the inner sprite to be kept, but got %v.", actual )
+  }
+}